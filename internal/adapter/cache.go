@@ -0,0 +1,163 @@
+package adapter
+
+import "encoding/json"
+
+var ephemeral = json.RawMessage(`{"type":"ephemeral"}`)
+
+// ApplyPromptCache 给 Anthropic 请求体自动插入 cache_control 断点：系统提示词、最后一个工具定义、
+// 最后一条消息，以及它之前最近的一条 user 消息（上一轮的断点，保证跨轮命中）。
+// 请求里已经有 cache_control 时说明客户端自己管理缓存，原样返回。
+func ApplyPromptCache(body []byte) []byte {
+	var raw map[string]json.RawMessage
+	if json.Unmarshal(body, &raw) != nil {
+		return body
+	}
+	system := toBlocks(raw["system"])
+	var tools []map[string]json.RawMessage
+	json.Unmarshal(raw["tools"], &tools)
+	var msgs []map[string]json.RawMessage
+	json.Unmarshal(raw["messages"], &msgs)
+	if hasCacheControl(system, tools, msgs) {
+		return body
+	}
+
+	if len(system) > 0 && markLast(system) {
+		raw["system"], _ = json.Marshal(system)
+	}
+
+	if len(tools) > 0 {
+		tools[len(tools)-1]["cache_control"] = ephemeral
+		raw["tools"], _ = json.Marshal(tools)
+	}
+
+	if len(msgs) > 0 {
+		last := len(msgs) - 1
+		targets := []int{last}
+		for i := last - 1; i >= 0; i-- {
+			if string(msgs[i]["role"]) == `"user"` {
+				targets = append(targets, i)
+				break
+			}
+		}
+		for _, i := range targets {
+			if blocks := toBlocks(msgs[i]["content"]); markLast(blocks) {
+				msgs[i]["content"], _ = json.Marshal(blocks)
+			}
+		}
+		raw["messages"], _ = json.Marshal(msgs)
+	}
+
+	newBody, err := json.Marshal(raw)
+	if err != nil {
+		return body
+	}
+	return newBody
+}
+
+// hasCacheControl 判断系统提示词、工具定义或消息内容块（包括 tool_result 里的内容）上是否已经有 cache_control，
+// 只看结构里的字段，文本里出现这个词不算
+func hasCacheControl(system, tools, msgs []map[string]json.RawMessage) bool {
+	var marked func(blocks []map[string]json.RawMessage) bool
+	marked = func(blocks []map[string]json.RawMessage) bool {
+		for _, b := range blocks {
+			if _, ok := b["cache_control"]; ok {
+				return true
+			}
+			if string(b["type"]) == `"tool_result"` && marked(toBlocks(b["content"])) {
+				return true
+			}
+		}
+		return false
+	}
+	if marked(system) || marked(tools) {
+		return true
+	}
+	for _, m := range msgs {
+		if marked(toBlocks(m["content"])) {
+			return true
+		}
+	}
+	return false
+}
+
+// toBlocks 把字符串或内容块数组统一成内容块数组
+func toBlocks(content json.RawMessage) []map[string]json.RawMessage {
+	var s string
+	if json.Unmarshal(content, &s) == nil {
+		if s == "" {
+			return nil
+		}
+		text, _ := json.Marshal(s)
+		return []map[string]json.RawMessage{{"type": json.RawMessage(`"text"`), "text": text}}
+	}
+	var blocks []map[string]json.RawMessage
+	json.Unmarshal(content, &blocks)
+	return blocks
+}
+
+// markLast 在最后一个可缓存的块上设置断点，thinking 块和空文本块不能带 cache_control
+func markLast(blocks []map[string]json.RawMessage) bool {
+	for i := len(blocks) - 1; i >= 0; i-- {
+		switch string(blocks[i]["type"]) {
+		case `"thinking"`, `"redacted_thinking"`:
+			continue
+		case `"text"`:
+			if string(blocks[i]["text"]) == `""` {
+				continue
+			}
+		}
+		blocks[i]["cache_control"] = ephemeral
+		return true
+	}
+	return false
+}
+
+// AddUsage 把 u 累加到 total 上，用于合并多个请求的用量
+func AddUsage(total *AnthropicUsage, u *AnthropicUsage) {
+	if u == nil {
+		return
+	}
+	total.InputTokens += u.InputTokens
+	total.OutputTokens += u.OutputTokens
+	total.CacheCreationInputTokens += u.CacheCreationInputTokens
+	total.CacheReadInputTokens += u.CacheReadInputTokens
+}
+
+// MergeUsage 合并流式事件里的用量。message_delta 里的数字是累计值，只覆盖非零字段
+func MergeUsage(dst *AnthropicUsage, u *AnthropicUsage) {
+	if u == nil {
+		return
+	}
+	if u.InputTokens > 0 {
+		dst.InputTokens = u.InputTokens
+	}
+	if u.OutputTokens > 0 {
+		dst.OutputTokens = u.OutputTokens
+	}
+	if u.CacheCreationInputTokens > 0 {
+		dst.CacheCreationInputTokens = u.CacheCreationInputTokens
+	}
+	if u.CacheReadInputTokens > 0 {
+		dst.CacheReadInputTokens = u.CacheReadInputTokens
+	}
+}
+
+// ToOAIUsage 转换用量。Anthropic 的 input_tokens 不含缓存读写部分，OpenAI 的 prompt_tokens 包含
+func ToOAIUsage(u *AnthropicUsage) *OAIUsage {
+	if u == nil {
+		return nil
+	}
+	prompt := u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+	usage := &OAIUsage{
+		PromptTokens:     prompt,
+		CompletionTokens: u.OutputTokens,
+		TotalTokens:      prompt + u.OutputTokens,
+	}
+	if u.CacheCreationInputTokens > 0 || u.CacheReadInputTokens > 0 {
+		usage.PromptTokensDetails = &PromptTokensDetails{
+			CachedTokens:        u.CacheReadInputTokens,
+			CacheCreationTokens: u.CacheCreationInputTokens,
+		}
+	}
+	return usage
+}
@@ -3,6 +3,8 @@ package adapter
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"strings"
 	"time"
 )
 
@@ -30,7 +32,29 @@ func ContentToString(raw json.RawMessage) string {
 	return string(raw)
 }
 
-func OpenaiToAnthropic(req OAIRequest, model string) AnthropicRequest {
+// DefaultMaxTokens 客户端没有指定 max_tokens 时使用的值（Anthropic 要求必填）
+const DefaultMaxTokens = 8192
+
+// Options 控制 OpenAI -> Anthropic 转换中依赖配置的行为
+type Options struct {
+	MaxImageBytes int // 单张图片大小上限，超过的图片替换为文字说明
+
+	// 以下来自上游模型的能力表
+	MaxOutputTokens   int  // 最大输出 token，0=未知，不限制
+	NoThinking        bool // 不支持 extended thinking
+	NoVision          bool // 不支持图片，图片替换为文字说明
+	NoTools           bool // 不支持工具调用
+	ExclusiveSampling bool // temperature 和 top_p 只能设置一个
+}
+
+func clampMaxTokens(n, limit int) int {
+	if limit > 0 && n > limit {
+		return limit
+	}
+	return n
+}
+
+func OpenaiToAnthropic(req OAIRequest, model string, opts Options) AnthropicRequest {
 	ar := AnthropicRequest{
 		Model:       model,
 		Stream:      req.Stream,
@@ -38,12 +62,17 @@ func OpenaiToAnthropic(req OAIRequest, model string) AnthropicRequest {
 		TopP:        req.TopP,
 	}
 
-	if req.MaxTokens != nil && *req.MaxTokens > 0 {
+	switch {
+	case req.MaxCompletionTokens != nil && *req.MaxCompletionTokens > 0:
+		ar.MaxTokens = *req.MaxCompletionTokens
+	case req.MaxTokens != nil && *req.MaxTokens > 0:
 		ar.MaxTokens = *req.MaxTokens
+	default:
+		ar.MaxTokens = DefaultMaxTokens
 	}
-	if ar.MaxTokens < 8192 {
-		ar.MaxTokens = 8192
-	}
+	ar.MaxTokens = clampMaxTokens(ar.MaxTokens, opts.MaxOutputTokens)
+
+	ar.StopSeqs = StopSequences(req.Stop)
 
 	for _, t := range req.Tools {
 		ar.Tools = append(ar.Tools, AnthropicTool{
@@ -53,26 +82,62 @@ func OpenaiToAnthropic(req OAIRequest, model string) AnthropicRequest {
 		})
 	}
 
-	if len(req.ToolChoice) > 0 && len(ar.Tools) > 0 {
-		var s string
-		if json.Unmarshal(req.ToolChoice, &s) == nil {
-			switch s {
-			case "auto":
-				ar.ToolChoice, _ = json.Marshal(map[string]string{"type": "auto"})
-			case "required":
-				ar.ToolChoice, _ = json.Marshal(map[string]string{"type": "any"})
-			case "none":
-				ar.Tools = nil
-			}
-		} else {
-			var obj struct {
-				Function struct {
-					Name string `json:"name"`
-				} `json:"function"`
+	if opts.NoTools && len(ar.Tools) > 0 {
+		log.Printf("[capability] model %s does not support tools, dropping %d tool(s)", model, len(ar.Tools))
+		ar.Tools = nil
+	}
+
+	if len(ar.Tools) > 0 {
+		var allowed []string
+		ar.ToolChoice, allowed = ToolChoiceToAnthropic(req.ToolChoice, req.ParallelToolCalls)
+		if kept := filterTools(ar.Tools, allowed); allowed != nil && len(kept) > 0 {
+			ar.Tools = kept
+		} else if allowed != nil {
+			// 允许的工具都不存在，保留定义但禁止调用
+			ar.ToolChoice = json.RawMessage(`{"type":"none"}`)
+		}
+	}
+
+	if thinking := thinkingFromRequest(req); thinking != nil {
+		t := *thinking
+		ar.Thinking = &t
+		if thinkingEnabled(ar.Thinking) && opts.NoThinking {
+			log.Printf("[capability] model %s does not support thinking, disabling thinking", model)
+			ar.Thinking = nil
+		}
+		if thinkingEnabled(ar.Thinking) && toolChoiceForced(ar.ToolChoice) {
+			log.Printf("[thinking] forced tool_choice is incompatible with thinking, disabling thinking")
+			ar.Thinking = nil
+		}
+		if thinkingEnabled(ar.Thinking) && missingToolThinking(req.Messages) {
+			log.Printf("[thinking] no thinking block for the pending tool call, disabling thinking")
+			ar.Thinking = nil
+		}
+		if thinkingEnabled(ar.Thinking) {
+			// 开启 thinking 时 max_tokens 必须大于 budget_tokens，且不能修改 temperature / top_p；
+			// 模型输出上限不够时压缩 budget
+			if ar.MaxTokens <= t.BudgetTokens {
+				ar.MaxTokens = clampMaxTokens(t.BudgetTokens+DefaultMaxTokens, opts.MaxOutputTokens)
 			}
-			if json.Unmarshal(req.ToolChoice, &obj) == nil && obj.Function.Name != "" {
-				ar.ToolChoice, _ = json.Marshal(map[string]string{"type": "tool", "name": obj.Function.Name})
+			if ar.MaxTokens <= t.BudgetTokens {
+				t.BudgetTokens = max(ar.MaxTokens/2, 1024)
 			}
+			ar.Temperature = nil
+			ar.TopP = nil
+		}
+	}
+	if opts.ExclusiveSampling && ar.Temperature != nil && ar.TopP != nil {
+		ar.TopP = nil
+	}
+
+	// response_format：合成一个工具，没有其它工具且未开启 thinking 时强制调用它，否则在系统提示里要求调用
+	rfTool, structured := responseFormatTool(req.ResponseFormat)
+	structured = structured && !opts.NoTools
+	forceRF := structured && !thinkingEnabled(ar.Thinking) && (len(ar.Tools) == 0 || toolChoiceType(ar.ToolChoice) == "none")
+	if structured {
+		ar.Tools = append(ar.Tools, rfTool)
+		if forceRF {
+			ar.ToolChoice, _ = json.Marshal(map[string]string{"type": "tool", "name": ResponseFormatTool})
 		}
 	}
 
@@ -88,12 +153,15 @@ func OpenaiToAnthropic(req OAIRequest, model string) AnthropicRequest {
 
 		if m.Role == "tool" {
 			role = "user"
-			blocks = append(blocks, ContentBlock{
-				Type:      "tool_result",
-				ToolUseID: m.ToolCallID,
-				Content:   m.Content,
-			})
+			result := ContentBlock{Type: "tool_result", ToolUseID: m.ToolCallID, IsError: m.IsError}
+			if content := ContentToBlocks(m.Content, opts); len(content) > 0 {
+				result.Content, _ = json.Marshal(content)
+			}
+			blocks = append(blocks, result)
 		} else if m.Role == "assistant" && len(m.ToolCalls) > 0 {
+			if thinkingEnabled(ar.Thinking) {
+				blocks = append(blocks, assistantThinking(m)...)
+			}
 			text := ContentToString(m.Content)
 			if text != "" {
 				blocks = append(blocks, ContentBlock{Type: "text", Text: text})
@@ -106,6 +174,8 @@ func OpenaiToAnthropic(req OAIRequest, model string) AnthropicRequest {
 					Input: json.RawMessage(tc.Function.Arguments),
 				})
 			}
+		} else if m.Role == "user" {
+			blocks = ContentToBlocks(m.Content, opts)
 		} else {
 			text := ContentToString(m.Content)
 			if text != "" {
@@ -123,6 +193,9 @@ func OpenaiToAnthropic(req OAIRequest, model string) AnthropicRequest {
 			var prev []ContentBlock
 			json.Unmarshal(msgs[len(msgs)-1].Content, &prev)
 			prev = append(prev, blocks...)
+			if role == "user" {
+				prev = toolResultsFirst(prev)
+			}
 			merged, _ := json.Marshal(prev)
 			msgs[len(msgs)-1].Content = merged
 		} else {
@@ -130,19 +203,158 @@ func OpenaiToAnthropic(req OAIRequest, model string) AnthropicRequest {
 		}
 	}
 
+	if structured && !forceRF {
+		if ar.System != "" {
+			ar.System += "\n\n"
+		}
+		ar.System += "When you give your final answer, call the " + ResponseFormatTool + " tool with it instead of replying in text."
+	}
+
 	ar.Messages = msgs
 	return ar
 }
 
+// toolResultsFirst 把 tool_result 块排到同一个 user 轮次的最前面，Anthropic 要求它们紧跟在 tool_use 之后
+func toolResultsFirst(blocks []ContentBlock) []ContentBlock {
+	sorted := make([]ContentBlock, 0, len(blocks))
+	for _, b := range blocks {
+		if b.Type == "tool_result" {
+			sorted = append(sorted, b)
+		}
+	}
+	for _, b := range blocks {
+		if b.Type != "tool_result" {
+			sorted = append(sorted, b)
+		}
+	}
+	return sorted
+}
+
+// ToolChoiceToAnthropic 把 OpenAI 的 tool_choice 和 parallel_tool_calls 转为 Anthropic 的 tool_choice。
+// allowed_tools 形式返回允许的工具名，调用方据此过滤工具定义；其它情况第二个返回值为 nil。
+// none 不再去掉工具定义，历史消息里的 tool_use 块仍然需要它们。
+func ToolChoiceToAnthropic(raw json.RawMessage, parallel *bool) (json.RawMessage, []string) {
+	choice := map[string]any{}
+	var allowed []string
+
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		switch s {
+		case "required":
+			choice["type"] = "any"
+		case "none":
+			choice["type"] = "none"
+		default:
+			choice["type"] = "auto"
+		}
+	} else {
+		var obj struct {
+			Type     string `json:"type"`
+			Name     string `json:"name"`
+			Function struct {
+				Name string `json:"name"`
+			} `json:"function"`
+			AllowedTools struct {
+				Mode  string `json:"mode"`
+				Tools []struct {
+					Name     string `json:"name"`
+					Function struct {
+						Name string `json:"name"`
+					} `json:"function"`
+				} `json:"tools"`
+			} `json:"allowed_tools"`
+		}
+		json.Unmarshal(raw, &obj)
+		switch {
+		case obj.Type == "allowed_tools":
+			allowed = []string{}
+			for _, t := range obj.AllowedTools.Tools {
+				name := t.Function.Name
+				if name == "" {
+					name = t.Name
+				}
+				allowed = append(allowed, name)
+			}
+			choice["type"] = "auto"
+			if obj.AllowedTools.Mode == "required" {
+				choice["type"] = "any"
+			}
+		case obj.Function.Name != "":
+			choice["type"], choice["name"] = "tool", obj.Function.Name
+		case obj.Name != "":
+			// Responses API 的扁平写法 {"type":"function","name":"..."}
+			choice["type"], choice["name"] = "tool", obj.Name
+		default:
+			choice["type"] = "auto"
+		}
+	}
+
+	if parallel != nil && !*parallel && choice["type"] != "none" {
+		choice["disable_parallel_tool_use"] = true
+	}
+	if len(raw) == 0 && len(choice) == 1 {
+		// 客户端没有指定，保持上游默认行为
+		return nil, allowed
+	}
+	out, _ := json.Marshal(choice)
+	return out, allowed
+}
+
+func toolChoiceType(choice json.RawMessage) string {
+	var tc struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(choice, &tc)
+	return tc.Type
+}
+
+func filterTools(tools []AnthropicTool, allowed []string) []AnthropicTool {
+	var kept []AnthropicTool
+	for _, t := range tools {
+		for _, name := range allowed {
+			if t.Name == name {
+				kept = append(kept, t)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// StopSequences 把 OpenAI 的 stop（字符串或数组）转为 Anthropic 的 stop_sequences，
+// Anthropic 不接受只含空白的序列，直接丢弃
+func StopSequences(raw json.RawMessage) []string {
+	if len(raw) == 0 {
+		return nil
+	}
+	var list []string
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		list = []string{s}
+	} else {
+		json.Unmarshal(raw, &list)
+	}
+	var seqs []string
+	for _, seq := range list {
+		if strings.TrimSpace(seq) != "" {
+			seqs = append(seqs, seq)
+		}
+	}
+	return seqs
+}
+
 func MapStopReason(reason string) string {
 	switch reason {
-	case "end_turn":
+	case "end_turn", "stop_sequence":
 		return "stop"
 	case "tool_use":
 		return "tool_calls"
-	case "max_tokens":
+	case "max_tokens", "model_context_window_exceeded":
 		return "length"
+	case "refusal":
+		return "content_filter"
 	default:
+		// pause_turn（服务端工具循环暂停）等在 OpenAI 中没有对应值
 		return "stop"
 	}
 }
@@ -150,13 +362,22 @@ func MapStopReason(reason string) string {
 func AnthropicToOpenai(resp AnthropicResponse, model string) OAIResponse {
 	msg := OAIMsg{Role: "assistant"}
 	toolIdx := 0
+	var structured *string // response_format 工具的参数，有时作为全部 content，丢弃其它文字
 	for _, block := range resp.Content {
 		switch block.Type {
 		case "text":
 			msg.Content += block.Text
 		case "thinking":
 			msg.ReasoningContent += block.Thinking
+			msg.ThinkingBlocks = append(msg.ThinkingBlocks, ContentBlock{Type: "thinking", Thinking: block.Thinking, Signature: block.Signature})
+		case "redacted_thinking":
+			msg.ThinkingBlocks = append(msg.ThinkingBlocks, ContentBlock{Type: "redacted_thinking", Data: block.Data})
 		case "tool_use":
+			if block.Name == ResponseFormatTool {
+				input := string(block.Input)
+				structured = &input
+				continue
+			}
 			inputStr, _ := json.Marshal(block.Input)
 			msg.ToolCalls = append(msg.ToolCalls, OAIToolCall{
 				Index: toolIdx,
@@ -171,22 +392,30 @@ func AnthropicToOpenai(resp AnthropicResponse, model string) OAIResponse {
 		}
 	}
 
+	if structured != nil {
+		msg.Content = *structured
+	}
+
+	var toolIDs []string
+	for _, tc := range msg.ToolCalls {
+		toolIDs = append(toolIDs, tc.ID)
+	}
+	storeThinking(toolIDs, msg.ThinkingBlocks)
+
 	fr := MapStopReason(resp.StopReason)
+	if fr == "tool_calls" && len(msg.ToolCalls) == 0 {
+		// 只调用了 response_format 的工具
+		fr = "stop"
+	}
 
 	oaiResp := OAIResponse{
 		ID:      "chatcmpl-" + resp.ID,
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
 		Model:   model,
-		Choices: []OAIChoice{{Index: 0, Message: &msg, FinishReason: &fr}},
-	}
-	if resp.Usage != nil {
-		oaiResp.Usage = &OAIUsage{
-			PromptTokens:     resp.Usage.InputTokens,
-			CompletionTokens: resp.Usage.OutputTokens,
-			TotalTokens:      resp.Usage.InputTokens + resp.Usage.OutputTokens,
-		}
+		Choices: []OAIChoice{{Index: 0, Message: &msg, FinishReason: &fr, StopReason: resp.StopSequence}},
 	}
+	oaiResp.Usage = ToOAIUsage(resp.Usage)
 	return oaiResp
 }
 
@@ -204,6 +433,13 @@ func AnthropicStreamEventToChunks(eventType string, data json.RawMessage, state
 
 	switch eventType {
 	case "message_start":
+		var start struct {
+			Message struct {
+				Usage *AnthropicUsage `json:"usage"`
+			} `json:"message"`
+		}
+		json.Unmarshal(data, &start)
+		MergeUsage(&state.Usage, start.Message.Usage)
 		chunks = append(chunks, makeChunk(OAIMsg{Role: "assistant"}, nil))
 
 	case "content_block_start":
@@ -212,9 +448,26 @@ func AnthropicStreamEventToChunks(eventType string, data json.RawMessage, state
 			ContentBlock ContentBlock `json:"content_block"`
 		}
 		json.Unmarshal(data, &block)
-		if block.ContentBlock.Type == "tool_use" {
+		state.BlockType = block.ContentBlock.Type
+		switch block.ContentBlock.Type {
+		case "thinking":
+			state.Thinking = ""
+			state.Signature = ""
+		case "redacted_thinking":
+			tb := ContentBlock{Type: "redacted_thinking", Data: block.ContentBlock.Data}
+			state.ThinkingBlocks = append(state.ThinkingBlocks, tb)
+			chunks = append(chunks, makeChunk(OAIMsg{ThinkingBlocks: []ContentBlock{tb}}, nil))
+		case "tool_use":
+			if block.ContentBlock.Name == ResponseFormatTool {
+				state.JSONBlock = true
+				// 工具参数才是最终答案，之前暂存的文字丢弃
+				state.SawJSONBlock = true
+				state.PendingText = ""
+				break
+			}
 			state.HasTool = true
 			state.ToolID = block.ContentBlock.ID
+			state.ToolIDs = append(state.ToolIDs, state.ToolID)
 			state.ToolName = block.ContentBlock.Name
 			state.ToolArgs = ""
 			tc := OAIToolCall{
@@ -234,16 +487,31 @@ func AnthropicStreamEventToChunks(eventType string, data json.RawMessage, state
 				Type        string `json:"type"`
 				Text        string `json:"text"`
 				Thinking    string `json:"thinking"`
+				Signature   string `json:"signature"`
 				PartialJSON string `json:"partial_json"`
 			} `json:"delta"`
 		}
 		json.Unmarshal(data, &d)
 		switch d.Delta.Type {
 		case "text_delta":
+			if state.Structured {
+				// 还不知道后面会不会调用 response_format 工具，先暂存，调用了就丢弃
+				if !state.SawJSONBlock {
+					state.PendingText += d.Delta.Text
+				}
+				break
+			}
 			chunks = append(chunks, makeChunk(OAIMsg{Content: d.Delta.Text}, nil))
 		case "thinking_delta":
+			state.Thinking += d.Delta.Thinking
 			chunks = append(chunks, makeChunk(OAIMsg{ReasoningContent: d.Delta.Thinking}, nil))
+		case "signature_delta":
+			state.Signature += d.Delta.Signature
 		case "input_json_delta":
+			if state.JSONBlock {
+				chunks = append(chunks, makeChunk(OAIMsg{Content: d.Delta.PartialJSON}, nil))
+				break
+			}
 			state.ToolArgs += d.Delta.PartialJSON
 			tc := OAIToolCall{
 				Index:    state.ToolIndex - 1,
@@ -254,24 +522,53 @@ func AnthropicStreamEventToChunks(eventType string, data json.RawMessage, state
 			chunks = append(chunks, makeChunk(OAIMsg{ToolCalls: []OAIToolCall{tc}}, nil))
 		}
 
+	case "content_block_stop":
+		if state.BlockType == "thinking" {
+			// thinking 块结束时带上 signature 完整发出一次，客户端可以在后续请求中回传
+			tb := ContentBlock{Type: "thinking", Thinking: state.Thinking, Signature: state.Signature}
+			state.ThinkingBlocks = append(state.ThinkingBlocks, tb)
+			chunks = append(chunks, makeChunk(OAIMsg{ThinkingBlocks: []ContentBlock{tb}}, nil))
+		}
+		state.BlockType = ""
+		state.JSONBlock = false
+
 	case "message_delta":
 		var d struct {
 			Delta struct {
-				StopReason string `json:"stop_reason"`
+				StopReason   string `json:"stop_reason"`
+				StopSequence string `json:"stop_sequence"`
 			} `json:"delta"`
 			Usage *AnthropicUsage `json:"usage"`
 		}
 		json.Unmarshal(data, &d)
+		if state.PendingText != "" {
+			// 没有调用 response_format 工具，暂存的文字就是回答
+			chunks = append(chunks, makeChunk(OAIMsg{Content: state.PendingText}, nil))
+			state.PendingText = ""
+		}
+		storeThinking(state.ToolIDs, state.ThinkingBlocks)
 		fr := MapStopReason(d.Delta.StopReason)
+		if fr == "tool_calls" && !state.HasTool {
+			fr = "stop"
+		}
 		chunk := makeChunk(OAIMsg{}, &fr)
-		if d.Usage != nil {
-			chunk.Usage = &OAIUsage{
-				PromptTokens:     d.Usage.InputTokens,
-				CompletionTokens: d.Usage.OutputTokens,
-				TotalTokens:      d.Usage.InputTokens + d.Usage.OutputTokens,
-			}
+		chunk.Choices[0].StopReason = d.Delta.StopSequence
+		MergeUsage(&state.Usage, d.Usage)
+		if !state.IncludeUsage {
+			usage := state.Usage
+			chunk.Usage = ToOAIUsage(&usage)
 		}
 		chunks = append(chunks, chunk)
+
+	case "message_stop":
+		if state.IncludeUsage {
+			// 与 OpenAI 一致：最后一个 chunk 的 choices 为空数组，只带 usage
+			usage := state.Usage
+			chunk := makeChunk(OAIMsg{}, nil)
+			chunk.Choices = []OAIChoice{}
+			chunk.Usage = ToOAIUsage(&usage)
+			chunks = append(chunks, chunk)
+		}
 	}
 
 	return chunks
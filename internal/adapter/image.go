@@ -0,0 +1,201 @@
+package adapter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const defaultMaxImageBytes = 5 * 1024 * 1024
+
+var supportedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// ContentToBlocks 把 OpenAI 的消息内容转换为 Anthropic 内容块，保持文字和图片的先后顺序
+func ContentToBlocks(raw json.RawMessage, opts Options) []ContentBlock {
+	if len(raw) == 0 {
+		return nil
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		if s == "" {
+			return nil
+		}
+		return []ContentBlock{{Type: "text", Text: s}}
+	}
+	var parts []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		ImageURL struct {
+			URL string `json:"url"`
+		} `json:"image_url"`
+		Source *ImageSource `json:"source"`
+	}
+	if json.Unmarshal(raw, &parts) != nil {
+		return []ContentBlock{{Type: "text", Text: string(raw)}}
+	}
+	var blocks []ContentBlock
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			if p.Text != "" {
+				blocks = append(blocks, ContentBlock{Type: "text", Text: p.Text})
+			}
+		case "image_url", "image":
+			if opts.NoVision {
+				blocks = append(blocks, ContentBlock{Type: "text", Text: "[image omitted: model does not support images]"})
+			} else if p.Type == "image_url" {
+				blocks = append(blocks, imageBlock(p.ImageURL.URL, opts))
+			} else if p.Source != nil {
+				// 已经是 Anthropic 格式
+				blocks = append(blocks, ContentBlock{Type: "image", Source: p.Source})
+			}
+		}
+	}
+	return blocks
+}
+
+func imageBlock(url string, opts Options) ContentBlock {
+	maxBytes := opts.MaxImageBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxImageBytes
+	}
+
+	if strings.HasPrefix(url, "data:") {
+		src, err := parseDataURL(url, maxBytes)
+		if err != nil {
+			log.Printf("[image] drop data url: %v", err)
+			return ContentBlock{Type: "text", Text: fmt.Sprintf("[image omitted: %v]", err)}
+		}
+		return ContentBlock{Type: "image", Source: src}
+	}
+
+	return ContentBlock{Type: "image", Source: &ImageSource{Type: "url", URL: url}}
+}
+
+// parseDataURL 解析 data:image/png;base64,xxxx 形式的图片
+func parseDataURL(url string, maxBytes int) (*ImageSource, error) {
+	meta, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !ok || !strings.HasSuffix(meta, ";base64") {
+		return nil, fmt.Errorf("unsupported data url")
+	}
+	mediaType := strings.TrimSuffix(meta, ";base64")
+	if !supportedImageTypes[mediaType] {
+		return nil, fmt.Errorf("unsupported image type %s", mediaType)
+	}
+	if base64.StdEncoding.DecodedLen(len(data)) > maxBytes+2 {
+		return nil, fmt.Errorf("image larger than %d bytes", maxBytes)
+	}
+	return &ImageSource{Type: "base64", MediaType: mediaType, Data: data}, nil
+}
+
+// InlineImages 把请求里 http(s) 图片下载为 data URL，同一请求的所有尝试共用下载结果；
+// 下载失败的保留原链接，交给上游自己去取
+func InlineImages(ctx context.Context, req *OAIRequest, maxBytes int) {
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxImageBytes
+	}
+	fetched := map[string]string{}
+	for i, m := range req.Messages {
+		var parts []map[string]json.RawMessage
+		if json.Unmarshal(m.Content, &parts) != nil {
+			continue
+		}
+		changed := false
+		for _, part := range parts {
+			var image struct {
+				URL string `json:"url"`
+			}
+			if json.Unmarshal(part["image_url"], &image) != nil ||
+				!strings.HasPrefix(image.URL, "http://") && !strings.HasPrefix(image.URL, "https://") {
+				continue
+			}
+			dataURL, ok := fetched[image.URL]
+			if !ok {
+				src, err := fetchImage(ctx, image.URL, maxBytes)
+				if err != nil {
+					log.Printf("[image] fetch %s failed, passing url through: %v", image.URL, err)
+				} else {
+					dataURL = "data:" + src.MediaType + ";base64," + src.Data
+				}
+				fetched[image.URL] = dataURL
+			}
+			if dataURL != "" {
+				part["image_url"], _ = json.Marshal(map[string]string{"url": dataURL})
+				changed = true
+			}
+		}
+		if changed {
+			req.Messages[i].Content, _ = json.Marshal(parts)
+		}
+	}
+}
+
+// imageClient 只允许连接公网地址，防止通过图片链接访问内网（SSRF）。
+// 在拨号时检查解析后的地址，重定向和 DNS 重绑定同样会被拦截；不走环境变量里的代理
+var imageClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: 10 * time.Second, Control: denyPrivateAddr}).DialContext,
+	},
+}
+
+func denyPrivateAddr(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("image address %s is not public", ip)
+	}
+	return nil
+}
+
+func fetchImage(ctx context.Context, url string, maxBytes int) (*ImageSource, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBytes {
+		return nil, fmt.Errorf("image larger than %d bytes", maxBytes)
+	}
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	if !supportedImageTypes[mediaType] {
+		mediaType = http.DetectContentType(data)
+	}
+	if !supportedImageTypes[mediaType] {
+		return nil, fmt.Errorf("unsupported image type %s", mediaType)
+	}
+	return &ImageSource{Type: "base64", MediaType: mediaType, Data: base64.StdEncoding.EncodeToString(data)}, nil
+}
@@ -0,0 +1,455 @@
+package adapter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 反向转换：Anthropic /v1/messages 请求发给 OpenAI 兼容的 provider，再把响应转回 Anthropic 格式
+
+type messagesRequest struct {
+	Model         string          `json:"model"`
+	System        json.RawMessage `json:"system,omitempty"` // 字符串或文本块数组
+	Messages      []AnthropicMsg  `json:"messages"`
+	MaxTokens     int             `json:"max_tokens"`
+	Temperature   *float64        `json:"temperature,omitempty"`
+	TopP          *float64        `json:"top_p,omitempty"`
+	StopSequences []string        `json:"stop_sequences,omitempty"`
+	Stream        bool            `json:"stream"`
+	Tools         []AnthropicTool `json:"tools,omitempty"`
+	ToolChoice    json.RawMessage `json:"tool_choice,omitempty"`
+	Thinking      *Thinking       `json:"thinking,omitempty"`
+}
+
+// MessagesToOpenAI 把 Anthropic Messages 请求体转为 OpenAI chat completions 请求。
+// reasoning 表示目标模型支持 reasoning_effort，不支持的模型会拒绝这个参数，thinking 直接丢弃
+func MessagesToOpenAI(body []byte, model string, reasoning bool) (OAIRequest, error) {
+	var mr messagesRequest
+	if err := json.Unmarshal(body, &mr); err != nil {
+		return OAIRequest{}, err
+	}
+
+	req := OAIRequest{
+		Model:       model,
+		Temperature: mr.Temperature,
+		TopP:        mr.TopP,
+		Stream:      mr.Stream,
+	}
+	if mr.MaxTokens > 0 {
+		req.MaxTokens = &mr.MaxTokens
+	}
+	if mr.Stream {
+		// 需要上游在流的最后返回用量，才能填 message_delta.usage
+		req.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+	if len(mr.StopSequences) > 0 {
+		req.Stop, _ = json.Marshal(mr.StopSequences)
+	}
+	if thinkingEnabled(mr.Thinking) && reasoning {
+		req.ReasoningEffort = EffortFromBudget(mr.Thinking.BudgetTokens)
+	}
+
+	for _, t := range mr.Tools {
+		if len(t.InputSchema) == 0 {
+			// 服务端工具（web_search 等）没有 input_schema，OpenAI 上游无法执行
+			continue
+		}
+		req.Tools = append(req.Tools, OAITool{
+			Type:     "function",
+			Function: OAIFunction{Name: t.Name, Description: t.Description, Parameters: t.InputSchema},
+		})
+	}
+	if len(req.Tools) > 0 {
+		req.ToolChoice, req.ParallelToolCalls = toolChoiceToOpenAI(mr.ToolChoice)
+	}
+
+	if system := blocksText(mr.System); system != "" {
+		req.Messages = append(req.Messages, OAIMessage{Role: "system", Content: mustJSON(system)})
+	}
+	for _, m := range mr.Messages {
+		req.Messages = append(req.Messages, messageToOpenAI(m)...)
+	}
+	return req, nil
+}
+
+// EffortFromBudget 把 thinking 的 budget_tokens 映射为最接近的 reasoning_effort
+func EffortFromBudget(budget int) string {
+	switch {
+	case budget <= reasoningBudgets["low"]:
+		return "low"
+	case budget <= reasoningBudgets["medium"]:
+		return "medium"
+	default:
+		return "high"
+	}
+}
+
+// toolChoiceToOpenAI 是 ToolChoiceToAnthropic 的反向转换
+func toolChoiceToOpenAI(raw json.RawMessage) (json.RawMessage, *bool) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var tc struct {
+		Type                   string `json:"type"`
+		Name                   string `json:"name"`
+		DisableParallelToolUse bool   `json:"disable_parallel_tool_use"`
+	}
+	json.Unmarshal(raw, &tc)
+	var parallel *bool
+	if tc.DisableParallelToolUse {
+		parallel = new(bool)
+	}
+	switch tc.Type {
+	case "any":
+		return mustJSON("required"), parallel
+	case "none":
+		return mustJSON("none"), nil
+	case "tool":
+		return mustJSON(map[string]any{"type": "function", "function": map[string]string{"name": tc.Name}}), parallel
+	default:
+		return mustJSON("auto"), parallel
+	}
+}
+
+// messageToOpenAI 转换一条 Anthropic 消息。user 消息里的 tool_result 拆成单独的 tool 消息，
+// 放在剩余内容之前；assistant 的 tool_use 转为 tool_calls，thinking 块丢弃
+func messageToOpenAI(m AnthropicMsg) []OAIMessage {
+	var s string
+	if json.Unmarshal(m.Content, &s) == nil {
+		return []OAIMessage{{Role: m.Role, Content: mustJSON(s)}}
+	}
+	var blocks []ContentBlock
+	json.Unmarshal(m.Content, &blocks)
+
+	if m.Role == "assistant" {
+		msg := OAIMessage{Role: "assistant"}
+		var text string
+		for _, b := range blocks {
+			switch b.Type {
+			case "text":
+				text += b.Text
+			case "tool_use":
+				args := string(b.Input)
+				if args == "" {
+					args = "{}"
+				}
+				msg.ToolCalls = append(msg.ToolCalls, OAIToolCall{
+					Index:    len(msg.ToolCalls),
+					ID:       b.ID,
+					Type:     "function",
+					Function: OAIFunctionCall{Name: b.Name, Arguments: args},
+				})
+			}
+		}
+		if text != "" || len(msg.ToolCalls) == 0 {
+			msg.Content = mustJSON(text)
+		}
+		return []OAIMessage{msg}
+	}
+
+	var msgs []OAIMessage
+	var parts []map[string]any
+	for _, b := range blocks {
+		switch b.Type {
+		case "tool_result":
+			text := blocksText(b.Content)
+			if b.IsError {
+				text = "Error: " + text
+			}
+			msgs = append(msgs, OAIMessage{Role: "tool", ToolCallID: b.ToolUseID, Content: mustJSON(text)})
+		case "text":
+			parts = append(parts, map[string]any{"type": "text", "text": b.Text})
+		case "image":
+			if url := imageURL(b.Source); url != "" {
+				parts = append(parts, map[string]any{"type": "image_url", "image_url": map[string]string{"url": url}})
+			}
+		}
+	}
+	if len(parts) > 0 {
+		msgs = append(msgs, OAIMessage{Role: m.Role, Content: mustJSON(parts)})
+	}
+	return msgs
+}
+
+// blocksText 取出字符串或内容块数组里的文字，图片等其它块用文字说明代替
+func blocksText(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var blocks []ContentBlock
+	json.Unmarshal(raw, &blocks)
+	var texts []string
+	for _, b := range blocks {
+		switch b.Type {
+		case "text":
+			texts = append(texts, b.Text)
+		case "image":
+			texts = append(texts, "[image omitted]")
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+func imageURL(src *ImageSource) string {
+	if src == nil {
+		return ""
+	}
+	if src.Type == "url" {
+		return src.URL
+	}
+	return "data:" + src.MediaType + ";base64," + src.Data
+}
+
+func mustJSON(v any) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// reverseStopReason 是 MapStopReason 的反向映射
+func reverseStopReason(finish string) string {
+	switch finish {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// ToAnthropicUsage 把 OpenAI 用量转为 Anthropic 用量，prompt_tokens 里的缓存命中部分拆到 cache_read_input_tokens
+func ToAnthropicUsage(u *OAIUsage) AnthropicUsage {
+	if u == nil {
+		return AnthropicUsage{}
+	}
+	usage := AnthropicUsage{InputTokens: u.PromptTokens, OutputTokens: u.CompletionTokens}
+	if u.PromptTokensDetails != nil {
+		usage.CacheReadInputTokens = u.PromptTokensDetails.CachedTokens
+		usage.InputTokens -= u.PromptTokensDetails.CachedTokens
+	}
+	return usage
+}
+
+// OpenAIToMessagesResponse 把 OpenAI chat completion 响应转为 Anthropic message
+func OpenAIToMessagesResponse(resp OAIResponse, model string) AnthropicResponse {
+	ar := AnthropicResponse{
+		ID:         "msg_" + strings.TrimPrefix(resp.ID, "chatcmpl-"),
+		Type:       "message",
+		Role:       "assistant",
+		Model:      model,
+		Content:    []ContentBlock{},
+		StopReason: "end_turn",
+	}
+	if len(resp.Choices) > 0 && resp.Choices[0].Message != nil {
+		msg := resp.Choices[0].Message
+		if msg.Content != "" {
+			ar.Content = append(ar.Content, ContentBlock{Type: "text", Text: msg.Content})
+		}
+		for _, tc := range msg.ToolCalls {
+			input := json.RawMessage(tc.Function.Arguments)
+			if !json.Valid(input) {
+				input = json.RawMessage("{}")
+			}
+			ar.Content = append(ar.Content, ContentBlock{Type: "tool_use", ID: tc.ID, Name: tc.Function.Name, Input: input})
+		}
+		if fr := resp.Choices[0].FinishReason; fr != nil {
+			ar.StopReason = reverseStopReason(*fr)
+		}
+	}
+	usage := ToAnthropicUsage(resp.Usage)
+	ar.Usage = &usage
+	return ar
+}
+
+// OpenAIErrorToAnthropic 把 OpenAI 格式的错误响应体转为 Anthropic 的错误格式
+func OpenAIErrorToAnthropic(body []byte, status int) []byte {
+	var oe struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	message := string(body)
+	if json.Unmarshal(body, &oe) == nil && oe.Error.Message != "" {
+		message = oe.Error.Message
+	}
+	errType := "api_error"
+	switch {
+	case status == 400:
+		errType = "invalid_request_error"
+	case status == 401:
+		errType = "authentication_error"
+	case status == 403:
+		errType = "permission_error"
+	case status == 404:
+		errType = "not_found_error"
+	case status == 429:
+		errType = "rate_limit_error"
+	case status == 529:
+		errType = "overloaded_error"
+	}
+	return mustJSON(map[string]any{"type": "error", "error": map[string]string{"type": errType, "message": message}})
+}
+
+// --- 流式 ---
+
+// MessagesStreamState 记录 OpenAI 流转 Anthropic 事件时的状态
+type MessagesStreamState struct {
+	Started    bool
+	BlockIndex int    // 下一个内容块的序号
+	BlockType  string // 当前打开的内容块类型，空表示没有
+	ToolIndex  int    // 当前工具块对应的 OpenAI tool_calls 序号
+	StopReason string
+	Usage      AnthropicUsage
+}
+
+// AnthropicEvent 一个 Anthropic SSE 事件，Data 里已经包含 type 字段
+type AnthropicEvent struct {
+	Type string
+	Data any
+}
+
+func FormatAnthropicEvent(e AnthropicEvent) string {
+	return fmt.Sprintf("event: %s\ndata: %s\n\n", e.Type, mustJSON(e.Data))
+}
+
+func event(typ string, fields map[string]any) AnthropicEvent {
+	fields["type"] = typ
+	return AnthropicEvent{Type: typ, Data: fields}
+}
+
+// OpenAIChunkToEvents 把一个 OpenAI 流式 chunk 转为 Anthropic 事件
+func OpenAIChunkToEvents(chunk OAIResponse, state *MessagesStreamState, model string) []AnthropicEvent {
+	var events []AnthropicEvent
+	if !state.Started {
+		state.Started = true
+		events = append(events, event("message_start", map[string]any{
+			"message": map[string]any{
+				"id":            "msg_" + strings.TrimPrefix(chunk.ID, "chatcmpl-"),
+				"type":          "message",
+				"role":          "assistant",
+				"model":         model,
+				"content":       []any{},
+				"stop_reason":   nil,
+				"stop_sequence": nil,
+				"usage":         AnthropicUsage{},
+			},
+		}))
+	}
+	if chunk.Usage != nil {
+		state.Usage = ToAnthropicUsage(chunk.Usage)
+	}
+	if len(chunk.Choices) == 0 {
+		return events
+	}
+
+	choice := chunk.Choices[0]
+	if d := choice.Delta; d != nil {
+		if d.Content != "" {
+			if state.BlockType != "text" {
+				events = append(events, state.startBlock("text", map[string]any{"type": "text", "text": ""})...)
+			}
+			events = append(events, event("content_block_delta", map[string]any{
+				"index": state.BlockIndex - 1,
+				"delta": map[string]any{"type": "text_delta", "text": d.Content},
+			}))
+		}
+		for _, tc := range d.ToolCalls {
+			// 同一个工具调用的后续 chunk 可能重复带 id，只按 index 判断是否是新的调用
+			if state.BlockType != "tool_use" || tc.Index != state.ToolIndex {
+				state.ToolIndex = tc.Index
+				events = append(events, state.startBlock("tool_use", map[string]any{
+					"type": "tool_use", "id": tc.ID, "name": tc.Function.Name, "input": map[string]any{},
+				})...)
+			}
+			if tc.Function.Arguments != "" {
+				events = append(events, event("content_block_delta", map[string]any{
+					"index": state.BlockIndex - 1,
+					"delta": map[string]any{"type": "input_json_delta", "partial_json": tc.Function.Arguments},
+				}))
+			}
+		}
+	}
+	if choice.FinishReason != nil {
+		state.StopReason = reverseStopReason(*choice.FinishReason)
+	}
+	return events
+}
+
+// startBlock 关闭当前内容块并打开一个新块
+func (s *MessagesStreamState) startBlock(typ string, block map[string]any) []AnthropicEvent {
+	events := s.stopBlock()
+	events = append(events, event("content_block_start", map[string]any{"index": s.BlockIndex, "content_block": block}))
+	s.BlockType = typ
+	s.BlockIndex++
+	return events
+}
+
+func (s *MessagesStreamState) stopBlock() []AnthropicEvent {
+	if s.BlockType == "" {
+		return nil
+	}
+	s.BlockType = ""
+	return []AnthropicEvent{event("content_block_stop", map[string]any{"index": s.BlockIndex - 1})}
+}
+
+var (
+	// ErrStreamOverloaded 表示上游在流中报告过载，FinishMessagesStream 据此发出 overloaded_error
+	ErrStreamOverloaded = errors.New("upstream overloaded")
+	// ErrStreamTruncated 表示上游流没有 finish_reason 就结束了
+	ErrStreamTruncated = errors.New("upstream stream ended without finish_reason")
+)
+
+// StreamChunkError 解析 OpenAI 流里的 error 对象（部分兼容服务在流中途出错时发送），不是错误时返回 nil
+func StreamChunkError(data []byte) error {
+	var oe struct {
+		Error *struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    any    `json:"code"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &oe) != nil || oe.Error == nil {
+		return nil
+	}
+	kind := strings.ToLower(oe.Error.Type + " " + fmt.Sprint(oe.Error.Code))
+	if strings.Contains(kind, "overloaded") || strings.Contains(kind, "529") {
+		return fmt.Errorf("%w: %s", ErrStreamOverloaded, oe.Error.Message)
+	}
+	return errors.New(oe.Error.Message)
+}
+
+// FinishMessagesStream 上游流结束后关闭最后一个内容块，发出 message_delta 和 message_stop。
+// 读取出错（err 非空）或一直没收到 finish_reason 时流是被截断的，只发 error 事件，
+// 不发 message_stop，避免客户端把不完整的回复当作正常结束
+func FinishMessagesStream(state *MessagesStreamState, model string, err error) []AnthropicEvent {
+	if err == nil && state.StopReason == "" {
+		err = ErrStreamTruncated
+	}
+	if err != nil {
+		errType := "api_error"
+		if errors.Is(err, ErrStreamOverloaded) {
+			errType = "overloaded_error"
+		}
+		return []AnthropicEvent{event("error", map[string]any{
+			"error": map[string]any{"type": errType, "message": err.Error()},
+		})}
+	}
+	var events []AnthropicEvent
+	if !state.Started {
+		events = OpenAIChunkToEvents(OAIResponse{}, state, model)
+	}
+	events = append(events, state.stopBlock()...)
+	events = append(events,
+		event("message_delta", map[string]any{
+			"delta": map[string]any{"stop_reason": state.StopReason, "stop_sequence": nil},
+			"usage": state.Usage,
+		}),
+		event("message_stop", map[string]any{}),
+	)
+	return events
+}
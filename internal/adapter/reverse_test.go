@@ -0,0 +1,290 @@
+package adapter
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMessagesToOpenAI(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		reasoning bool
+		check     func(t *testing.T, req OAIRequest)
+	}{
+		{
+			name: "system and string content",
+			body: `{"model":"m","max_tokens":100,"system":[{"type":"text","text":"be brief"}],"messages":[{"role":"user","content":"hi"}]}`,
+			check: func(t *testing.T, req OAIRequest) {
+				if len(req.Messages) != 2 || req.Messages[0].Role != "system" || string(req.Messages[0].Content) != `"be brief"` {
+					t.Fatalf("messages = %+v", req.Messages)
+				}
+				if req.MaxTokens == nil || *req.MaxTokens != 100 {
+					t.Fatalf("max_tokens = %v", req.MaxTokens)
+				}
+			},
+		},
+		{
+			name: "tool_use becomes tool_calls",
+			body: `{"model":"m","messages":[{"role":"assistant","content":[{"type":"thinking","thinking":"x","signature":"s"},{"type":"tool_use","id":"t1","name":"get","input":{"a":1}}]}]}`,
+			check: func(t *testing.T, req OAIRequest) {
+				m := req.Messages[0]
+				if len(m.ToolCalls) != 1 || m.ToolCalls[0].ID != "t1" || m.ToolCalls[0].Function.Arguments != `{"a":1}` {
+					t.Fatalf("tool_calls = %+v", m.ToolCalls)
+				}
+				if m.Content != nil {
+					t.Fatalf("content = %s, want none", m.Content)
+				}
+			},
+		},
+		{
+			name: "tool_result split before remaining content",
+			body: `{"model":"m","messages":[{"role":"user","content":[{"type":"text","text":"next"},{"type":"tool_result","tool_use_id":"t1","content":"boom","is_error":true}]}]}`,
+			check: func(t *testing.T, req OAIRequest) {
+				if len(req.Messages) != 2 {
+					t.Fatalf("messages = %+v", req.Messages)
+				}
+				tool, user := req.Messages[0], req.Messages[1]
+				if tool.Role != "tool" || tool.ToolCallID != "t1" || string(tool.Content) != `"Error: boom"` {
+					t.Fatalf("tool message = %+v", tool)
+				}
+				if user.Role != "user" || !strings.Contains(string(user.Content), "next") {
+					t.Fatalf("user message = %+v", user)
+				}
+			},
+		},
+		{
+			name: "base64 image becomes data url",
+			body: `{"model":"m","messages":[{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}}]}]}`,
+			check: func(t *testing.T, req OAIRequest) {
+				if !strings.Contains(string(req.Messages[0].Content), "data:image/png;base64,AAAA") {
+					t.Fatalf("content = %s", req.Messages[0].Content)
+				}
+			},
+		},
+		{
+			name: "server tools dropped and tool_choice mapped",
+			body: `{"model":"m","messages":[],"tools":[{"name":"get","input_schema":{"type":"object"}},{"type":"web_search_20250305","name":"web_search"}],"tool_choice":{"type":"any","disable_parallel_tool_use":true}}`,
+			check: func(t *testing.T, req OAIRequest) {
+				if len(req.Tools) != 1 || req.Tools[0].Function.Name != "get" {
+					t.Fatalf("tools = %+v", req.Tools)
+				}
+				if string(req.ToolChoice) != `"required"` || req.ParallelToolCalls == nil || *req.ParallelToolCalls {
+					t.Fatalf("tool_choice = %s, parallel = %v", req.ToolChoice, req.ParallelToolCalls)
+				}
+			},
+		},
+		{
+			name:      "thinking to reasoning_effort",
+			body:      `{"model":"m","messages":[],"thinking":{"type":"enabled","budget_tokens":10000}}`,
+			reasoning: true,
+			check: func(t *testing.T, req OAIRequest) {
+				if req.ReasoningEffort != "medium" {
+					t.Fatalf("reasoning_effort = %q", req.ReasoningEffort)
+				}
+			},
+		},
+		{
+			name: "thinking dropped for non-reasoning model",
+			body: `{"model":"m","messages":[],"thinking":{"type":"enabled","budget_tokens":10000}}`,
+			check: func(t *testing.T, req OAIRequest) {
+				if req.ReasoningEffort != "" {
+					t.Fatalf("reasoning_effort = %q, want none", req.ReasoningEffort)
+				}
+			},
+		},
+		{
+			name: "stream asks for usage",
+			body: `{"model":"m","messages":[],"stream":true}`,
+			check: func(t *testing.T, req OAIRequest) {
+				if req.StreamOptions == nil || !req.StreamOptions.IncludeUsage {
+					t.Fatalf("stream_options = %+v", req.StreamOptions)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := MessagesToOpenAI([]byte(tt.body), "target", tt.reasoning)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Model != "target" {
+				t.Fatalf("model = %q", req.Model)
+			}
+			tt.check(t, req)
+		})
+	}
+}
+
+func TestOpenAIChunkToEvents(t *testing.T) {
+	text := func(s string) OAIResponse {
+		return OAIResponse{ID: "chatcmpl-1", Choices: []OAIChoice{{Delta: &OAIMsg{Content: s}}}}
+	}
+	tool := func(index int, id, name, args string) OAIResponse {
+		tc := OAIToolCall{Index: index, ID: id, Function: OAIFunctionCall{Name: name, Arguments: args}}
+		return OAIResponse{ID: "chatcmpl-1", Choices: []OAIChoice{{Delta: &OAIMsg{ToolCalls: []OAIToolCall{tc}}}}}
+	}
+	finish := func(reason string) OAIResponse {
+		return OAIResponse{ID: "chatcmpl-1", Choices: []OAIChoice{{Delta: &OAIMsg{}, FinishReason: &reason}}}
+	}
+	usage := OAIResponse{ID: "chatcmpl-1", Choices: []OAIChoice{}, Usage: &OAIUsage{PromptTokens: 10, CompletionTokens: 5}}
+
+	tests := []struct {
+		name       string
+		chunks     []OAIResponse
+		err        error
+		want       []string // 事件类型序列，content_block_start 带上块类型
+		stopReason string   // 以 error 结束时为 error.type
+	}{
+		{
+			name:       "text",
+			chunks:     []OAIResponse{text("he"), text("llo"), finish("stop"), usage},
+			want:       []string{"message_start", "content_block_start:text", "content_block_delta", "content_block_delta", "content_block_stop", "message_delta", "message_stop"},
+			stopReason: "end_turn",
+		},
+		{
+			name:       "repeated id stays in one block",
+			chunks:     []OAIResponse{tool(0, "call_1", "get", ""), tool(0, "call_1", "", `{"a"`), tool(0, "call_1", "", `:1}`), finish("tool_calls")},
+			want:       []string{"message_start", "content_block_start:tool_use", "content_block_delta", "content_block_delta", "content_block_stop", "message_delta", "message_stop"},
+			stopReason: "tool_use",
+		},
+		{
+			name:   "new index opens new block",
+			chunks: []OAIResponse{text("ok"), tool(0, "call_1", "a", "{}"), tool(1, "call_2", "b", "{}"), finish("tool_calls")},
+			want: []string{"message_start", "content_block_start:text", "content_block_delta", "content_block_stop",
+				"content_block_start:tool_use", "content_block_delta", "content_block_stop",
+				"content_block_start:tool_use", "content_block_delta", "content_block_stop", "message_delta", "message_stop"},
+			stopReason: "tool_use",
+		},
+		{
+			name:       "length",
+			chunks:     []OAIResponse{text("x"), finish("length")},
+			want:       []string{"message_start", "content_block_start:text", "content_block_delta", "content_block_stop", "message_delta", "message_stop"},
+			stopReason: "max_tokens",
+		},
+		{
+			name:       "empty stream",
+			want:       []string{"error"},
+			stopReason: "api_error",
+		},
+		{
+			name:       "missing finish_reason",
+			chunks:     []OAIResponse{text("x")},
+			want:       []string{"message_start", "content_block_start:text", "content_block_delta", "error"},
+			stopReason: "api_error",
+		},
+		{
+			name:       "overloaded mid-stream",
+			chunks:     []OAIResponse{text("x")},
+			err:        StreamChunkError([]byte(`{"error":{"message":"busy","type":"overloaded_error"}}`)),
+			want:       []string{"message_start", "content_block_start:text", "content_block_delta", "error"},
+			stopReason: "overloaded_error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &MessagesStreamState{}
+			var events []AnthropicEvent
+			for _, c := range tt.chunks {
+				events = append(events, OpenAIChunkToEvents(c, state, "m")...)
+			}
+			events = append(events, FinishMessagesStream(state, "m", tt.err)...)
+
+			var got []string
+			for _, e := range events {
+				typ := e.Type
+				if typ == "content_block_start" {
+					var d struct {
+						ContentBlock struct {
+							Type string `json:"type"`
+						} `json:"content_block"`
+					}
+					json.Unmarshal(mustJSON(e.Data), &d)
+					typ += ":" + d.ContentBlock.Type
+				}
+				got = append(got, typ)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("events = %v\nwant     %v", got, tt.want)
+			}
+			var last struct {
+				Delta struct {
+					StopReason string `json:"stop_reason"`
+				} `json:"delta"`
+				Error struct {
+					Type string `json:"type"`
+				} `json:"error"`
+			}
+			if got[len(got)-1] == "error" {
+				json.Unmarshal(mustJSON(events[len(events)-1].Data), &last)
+				if last.Error.Type != tt.stopReason {
+					t.Fatalf("error type = %q, want %q", last.Error.Type, tt.stopReason)
+				}
+				return
+			}
+			json.Unmarshal(mustJSON(events[len(events)-2].Data), &last)
+			if last.Delta.StopReason != tt.stopReason {
+				t.Fatalf("stop_reason = %q, want %q", last.Delta.StopReason, tt.stopReason)
+			}
+		})
+	}
+}
+
+func TestOpenAIToMessagesResponse(t *testing.T) {
+	fr := "tool_calls"
+	resp := OAIResponse{
+		ID: "chatcmpl-abc",
+		Choices: []OAIChoice{{Message: &OAIMsg{
+			Content: "calling",
+			ToolCalls: []OAIToolCall{
+				{ID: "call_1", Function: OAIFunctionCall{Name: "get", Arguments: `{"a":1}`}},
+				{ID: "call_2", Function: OAIFunctionCall{Name: "bad", Arguments: `{"a":`}},
+			},
+		}, FinishReason: &fr}},
+		Usage: &OAIUsage{PromptTokens: 10, CompletionTokens: 3, PromptTokensDetails: &PromptTokensDetails{CachedTokens: 4}},
+	}
+	ar := OpenAIToMessagesResponse(resp, "m")
+	if ar.ID != "msg_abc" || ar.StopReason != "tool_use" || len(ar.Content) != 3 {
+		t.Fatalf("response = %+v", ar)
+	}
+	if string(ar.Content[2].Input) != "{}" {
+		t.Fatalf("invalid arguments not replaced: %s", ar.Content[2].Input)
+	}
+	if *ar.Usage != (AnthropicUsage{InputTokens: 6, OutputTokens: 3, CacheReadInputTokens: 4}) {
+		t.Fatalf("usage = %+v", *ar.Usage)
+	}
+}
+
+func TestOpenAIErrorToAnthropic(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		wantType string
+		wantMsg  string
+	}{
+		{"openai error", `{"error":{"message":"bad model","type":"invalid_request_error"}}`, 400, "invalid_request_error", "bad model"},
+		{"rate limit", `{"error":{"message":"slow down"}}`, 429, "rate_limit_error", "slow down"},
+		{"overloaded", `{"error":{"message":"busy"}}`, 529, "overloaded_error", "busy"},
+		{"plain text", `upstream exploded`, 500, "api_error", "upstream exploded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got struct {
+				Type  string `json:"type"`
+				Error struct {
+					Type    string `json:"type"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(OpenAIErrorToAnthropic([]byte(tt.body), tt.status), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Type != "error" || got.Error.Type != tt.wantType || got.Error.Message != tt.wantMsg {
+				t.Fatalf("got %+v", got)
+			}
+		})
+	}
+}
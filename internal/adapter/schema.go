@@ -0,0 +1,196 @@
+package adapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// ResponseFormatTool 是为 response_format 合成的工具名，上游调用它时把参数当作 message.content 返回
+const ResponseFormatTool = "json_response"
+
+type ResponseFormat struct {
+	Type       string            `json:"type"` // text / json_object / json_schema
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      bool            `json:"strict,omitempty"`
+}
+
+// HasStructuredOutput 判断请求是否通过合成工具实现 response_format
+func HasStructuredOutput(rf *ResponseFormat) bool {
+	_, ok := responseFormatTool(rf)
+	return ok
+}
+
+// responseFormatTool 把 response_format 转为一个 input_schema 为目标 schema 的工具
+func responseFormatTool(rf *ResponseFormat) (AnthropicTool, bool) {
+	if rf == nil {
+		return AnthropicTool{}, false
+	}
+	tool := AnthropicTool{
+		Name:        ResponseFormatTool,
+		Description: "Respond to the user with a JSON object. The tool input is the final answer.",
+		InputSchema: json.RawMessage(`{"type":"object"}`),
+	}
+	switch rf.Type {
+	case "json_object":
+	case "json_schema":
+		if rf.JSONSchema == nil {
+			return AnthropicTool{}, false
+		}
+		if rf.JSONSchema.Description != "" {
+			tool.Description += " " + rf.JSONSchema.Description
+		}
+		if len(rf.JSONSchema.Schema) > 0 {
+			tool.InputSchema = rf.JSONSchema.Schema
+		}
+	default:
+		return AnthropicTool{}, false
+	}
+	return tool, true
+}
+
+// ValidateResponseFormat 检查 content 是否满足 response_format：json_object 只检查是否为合法 JSON，
+// json_schema 再按 schema 校验
+func ValidateResponseFormat(rf *ResponseFormat, content string) error {
+	if rf == nil || (rf.Type != "json_object" && rf.Type != "json_schema") {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal([]byte(content), &v); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	if rf.Type != "json_schema" || rf.JSONSchema == nil || len(rf.JSONSchema.Schema) == 0 {
+		return nil
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(rf.JSONSchema.Schema, &schema); err != nil {
+		return nil
+	}
+	return validateSchema(schema, v, "$")
+}
+
+// validateSchema 只实现常用的 JSON Schema 关键字：type、enum、const、properties、required、
+// additionalProperties、items、anyOf
+func validateSchema(schema map[string]any, v any, path string) error {
+	if t, ok := schema["type"]; ok && !matchesType(t, v) {
+		return fmt.Errorf("%s: expected type %v", path, t)
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			found = found || reflect.DeepEqual(e, v)
+		}
+		if !found {
+			return fmt.Errorf("%s: value not in enum", path)
+		}
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, v) {
+		return fmt.Errorf("%s: value does not match const", path)
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		var firstErr error
+		matched := false
+		for _, sub := range anyOf {
+			s, _ := sub.(map[string]any)
+			err := validateSchema(s, v, path)
+			if err == nil {
+				matched = true
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if !matched {
+			return firstErr
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		if required, ok := schema["required"].([]any); ok {
+			for _, r := range required {
+				name, _ := r.(string)
+				if _, ok := val[name]; !ok {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+		for k, item := range val {
+			if sub, ok := props[k].(map[string]any); ok {
+				if err := validateSchema(sub, item, path+"."+k); err != nil {
+					return err
+				}
+				continue
+			}
+			switch ap := schema["additionalProperties"].(type) {
+			case bool:
+				if !ap {
+					return fmt.Errorf("%s: unexpected property %q", path, k)
+				}
+			case map[string]any:
+				if err := validateSchema(ap, item, path+"."+k); err != nil {
+					return err
+				}
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range val {
+				if err := validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func matchesType(t any, v any) bool {
+	switch tt := t.(type) {
+	case string:
+		return matchesTypeName(tt, v)
+	case []any:
+		for _, name := range tt {
+			if s, ok := name.(string); ok && matchesTypeName(s, v) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesTypeName(name string, v any) bool {
+	switch name {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package adapter
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateResponseFormat(t *testing.T) {
+	schema := func(s string) *ResponseFormat {
+		return &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Name: "out", Schema: json.RawMessage(s)}}
+	}
+	person := `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string"},
+			"age": {"type": "integer"},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"role": {"enum": ["admin", "user"]},
+			"kind": {"const": "person"},
+			"email": {"anyOf": [{"type": "string"}, {"type": "null"}]}
+		},
+		"required": ["name", "age"],
+		"additionalProperties": false
+	}`
+	tests := []struct {
+		name    string
+		rf      *ResponseFormat
+		content string
+		wantErr bool
+	}{
+		{"no response_format", nil, "not json", false},
+		{"text format", &ResponseFormat{Type: "text"}, "not json", false},
+		{"json_object valid", &ResponseFormat{Type: "json_object"}, `{"a":1}`, false},
+		{"json_object invalid", &ResponseFormat{Type: "json_object"}, `{"a":`, true},
+		{"schema without body", &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Name: "x"}}, `[1]`, false},
+		{"valid", schema(person), `{"name":"a","age":3,"tags":["x"],"role":"admin","kind":"person","email":null}`, false},
+		{"missing required", schema(person), `{"name":"a"}`, true},
+		{"wrong type", schema(person), `{"name":1,"age":3}`, true},
+		{"integer rejects fraction", schema(person), `{"name":"a","age":3.5}`, true},
+		{"integer accepts whole float", schema(person), `{"name":"a","age":3.0}`, false},
+		{"additional property", schema(person), `{"name":"a","age":3,"extra":true}`, true},
+		{"array item type", schema(person), `{"name":"a","age":3,"tags":[1]}`, true},
+		{"enum miss", schema(person), `{"name":"a","age":3,"role":"root"}`, true},
+		{"const miss", schema(person), `{"name":"a","age":3,"kind":"robot"}`, true},
+		{"anyOf miss", schema(person), `{"name":"a","age":3,"email":5}`, true},
+		{"top-level type", schema(person), `[]`, true},
+		{"type list", schema(`{"type":["string","null"]}`), `null`, false},
+		{"type list miss", schema(`{"type":["string","null"]}`), `1`, true},
+		{"additionalProperties schema", schema(`{"type":"object","additionalProperties":{"type":"number"}}`), `{"a":1,"b":"x"}`, true},
+		{"invalid schema ignored", schema(`{`), `{"a":1}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateResponseFormat(tt.rf, tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateResponseFormat(%s) error = %v, wantErr %v", tt.content, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResponseFormatToolReplacesContent(t *testing.T) {
+	resp := AnthropicResponse{
+		ID:         "msg_1",
+		StopReason: "tool_use",
+		Content: []ContentBlock{
+			{Type: "text", Text: "Here is the answer:"},
+			{Type: "tool_use", ID: "toolu_1", Name: ResponseFormatTool, Input: json.RawMessage(`{"a":1}`)},
+		},
+	}
+	oai := AnthropicToOpenai(resp, "m")
+	if got := oai.Choices[0].Message.Content; got != `{"a":1}` {
+		t.Fatalf("content = %q", got)
+	}
+	if fr := *oai.Choices[0].FinishReason; fr != "stop" {
+		t.Fatalf("finish_reason = %q", fr)
+	}
+}
+
+func TestResponseFormatStream(t *testing.T) {
+	type event struct{ event, data string }
+	text := []event{
+		{"content_block_start", `{"index":0,"content_block":{"type":"text","text":""}}`},
+		{"content_block_delta", `{"index":0,"delta":{"type":"text_delta","text":"Sure:"}}`},
+		{"content_block_stop", `{"index":0}`},
+	}
+	tool := []event{
+		{"content_block_start", `{"index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"` + ResponseFormatTool + `"}}`},
+		{"content_block_delta", `{"index":1,"delta":{"type":"input_json_delta","partial_json":"{\"a\":"}}`},
+		{"content_block_delta", `{"index":1,"delta":{"type":"input_json_delta","partial_json":"1}"}}`},
+		{"content_block_stop", `{"index":1}`},
+	}
+	start := event{"message_start", `{"message":{"usage":{"input_tokens":1}}}`}
+	stop := event{"message_delta", `{"delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`}
+	concat := func(parts ...[]event) []event {
+		var all []event
+		for _, p := range parts {
+			all = append(all, p...)
+		}
+		return all
+	}
+	tests := []struct {
+		name       string
+		structured bool
+		events     []event
+		want       string
+	}{
+		{"text dropped when tool called", true, concat([]event{start}, text, tool, []event{stop}), `{"a":1}`},
+		{"text kept without tool call", true, concat([]event{start}, text, []event{stop}), "Sure:"},
+		{"plain request streams text", false, concat([]event{start}, text, []event{stop}), "Sure:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &StreamState{Structured: tt.structured}
+			var content string
+			for _, e := range tt.events {
+				for _, chunk := range AnthropicStreamEventToChunks(e.event, json.RawMessage(e.data), state, "m") {
+					for _, c := range chunk.Choices {
+						if c.Delta != nil {
+							content += c.Delta.Content
+						}
+					}
+				}
+			}
+			if content != tt.want {
+				t.Fatalf("content = %q, want %q", content, tt.want)
+			}
+		})
+	}
+}
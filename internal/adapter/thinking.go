@@ -0,0 +1,96 @@
+package adapter
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// reasoning_effort 对应的 thinking budget_tokens
+var reasoningBudgets = map[string]int{
+	"minimal": 1024,
+	"low":     4096,
+	"medium":  16000,
+	"high":    32000,
+}
+
+func thinkingFromRequest(req OAIRequest) *Thinking {
+	if req.Thinking != nil {
+		return req.Thinking
+	}
+	if budget, ok := reasoningBudgets[req.ReasoningEffort]; ok {
+		return &Thinking{Type: "enabled", BudgetTokens: budget}
+	}
+	return nil
+}
+
+func thinkingEnabled(t *Thinking) bool {
+	return t != nil && t.Type == "enabled"
+}
+
+// toolChoiceForced 判断 tool_choice 是否强制调用工具，Anthropic 不允许和 thinking 同时使用
+func toolChoiceForced(choice json.RawMessage) bool {
+	t := toolChoiceType(choice)
+	return t == "any" || t == "tool"
+}
+
+// 大多数 OpenAI 客户端（包括 Cursor）不会回传 thinking 块，但开启 thinking 时
+// 带工具调用的 assistant 轮次必须以原来的 thinking 块开头。这里按 tool_use ID
+// 缓存上游返回的 thinking 块，下一轮请求时补回去。
+const thinkingCacheSize = 4096
+
+var (
+	thinkingCache   = map[string][]ContentBlock{}
+	thinkingOrder   []string
+	thinkingCacheMu sync.Mutex
+)
+
+func storeThinking(toolIDs []string, blocks []ContentBlock) {
+	if len(toolIDs) == 0 || len(blocks) == 0 {
+		return
+	}
+	thinkingCacheMu.Lock()
+	defer thinkingCacheMu.Unlock()
+	for _, id := range toolIDs {
+		if _, ok := thinkingCache[id]; !ok {
+			thinkingOrder = append(thinkingOrder, id)
+		}
+		thinkingCache[id] = blocks
+	}
+	for len(thinkingOrder) > thinkingCacheSize {
+		delete(thinkingCache, thinkingOrder[0])
+		thinkingOrder = thinkingOrder[1:]
+	}
+}
+
+func lookupThinking(toolID string) []ContentBlock {
+	thinkingCacheMu.Lock()
+	defer thinkingCacheMu.Unlock()
+	return thinkingCache[toolID]
+}
+
+// assistantThinking 返回需要放在 assistant 轮次开头的 thinking 块：
+// 优先用客户端回传的 thinking_blocks，否则按第一个工具调用 ID 查缓存
+func assistantThinking(m OAIMessage) []ContentBlock {
+	var blocks []ContentBlock
+	for _, b := range m.ThinkingBlocks {
+		if (b.Type == "thinking" && b.Signature != "") || (b.Type == "redacted_thinking" && b.Data != "") {
+			blocks = append(blocks, b)
+		}
+	}
+	if len(blocks) > 0 || len(m.ToolCalls) == 0 {
+		return blocks
+	}
+	return lookupThinking(m.ToolCalls[0].ID)
+}
+
+// missingToolThinking 判断最后一个 assistant 轮次是否带工具调用却找不到对应的 thinking 块
+// （客户端没回传、缓存也没有命中）。Anthropic 只要求最后一个 assistant 轮次保留 thinking，
+// 缺失时只能关闭本次请求的 thinking，否则上游会直接拒绝
+func missingToolThinking(msgs []OAIMessage) bool {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == "assistant" {
+			return len(msgs[i].ToolCalls) > 0 && len(assistantThinking(msgs[i])) == 0
+		}
+	}
+	return false
+}
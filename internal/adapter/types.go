@@ -5,16 +5,30 @@ import "encoding/json"
 // --- OpenAI Types ---
 
 type OAIRequest struct {
-	Model       string          `json:"model"`
-	Messages    []OAIMessage    `json:"messages"`
-	MaxTokens   *int            `json:"max_tokens,omitempty"`
-	Temperature *float64        `json:"temperature,omitempty"`
-	TopP        *float64        `json:"top_p,omitempty"`
-	Stream      bool            `json:"stream"`
-	Tools       []OAITool       `json:"tools,omitempty"`
-	ToolChoice  json.RawMessage `json:"tool_choice,omitempty"`
-	Stop        json.RawMessage `json:"stop,omitempty"`
-	System      json.RawMessage `json:"system,omitempty"`
+	Model     string       `json:"model"`
+	Messages  []OAIMessage `json:"messages"`
+	MaxTokens *int         `json:"max_tokens,omitempty"`
+	// MaxCompletionTokens 新版 OpenAI 参数，优先于 max_tokens
+	MaxCompletionTokens *int            `json:"max_completion_tokens,omitempty"`
+	Temperature         *float64        `json:"temperature,omitempty"`
+	TopP                *float64        `json:"top_p,omitempty"`
+	Stream              bool            `json:"stream"`
+	N                   *int            `json:"n,omitempty"` // Anthropic 没有对应参数，由代理并发请求后合并
+	Tools               []OAITool       `json:"tools,omitempty"`
+	ToolChoice          json.RawMessage `json:"tool_choice,omitempty"`
+	// ParallelToolCalls 为 false 时映射为 disable_parallel_tool_use
+	ParallelToolCalls *bool           `json:"parallel_tool_calls,omitempty"`
+	Stop              json.RawMessage `json:"stop,omitempty"`
+	System            json.RawMessage `json:"system,omitempty"`
+	Thinking          *Thinking       `json:"thinking,omitempty"` // 扩展字段，直接对应 Anthropic 的 thinking，优先于 reasoning_effort
+	// ReasoningEffort 映射为 thinking.budget_tokens
+	ReasoningEffort string          `json:"reasoning_effort,omitempty"`
+	ResponseFormat  *ResponseFormat `json:"response_format,omitempty"`
+	StreamOptions   *StreamOptions  `json:"stream_options,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type OAIMessage struct {
@@ -23,6 +37,10 @@ type OAIMessage struct {
 	Name       string          `json:"name,omitempty"`
 	ToolCalls  []OAIToolCall   `json:"tool_calls,omitempty"`
 	ToolCallID string          `json:"tool_call_id,omitempty"`
+	// ThinkingBlocks 扩展字段：客户端回传的 thinking 块（带 signature），附加到 assistant 轮次
+	ThinkingBlocks []ContentBlock `json:"thinking_blocks,omitempty"`
+	// IsError 扩展字段：tool 消息表示工具执行失败，对应 tool_result 的 is_error
+	IsError bool `json:"is_error,omitempty"`
 }
 
 type OAIToolCall struct {
@@ -86,6 +104,8 @@ type OAIChoice struct {
 	Message      *OAIMsg `json:"message,omitempty"`
 	Delta        *OAIMsg `json:"delta,omitempty"`
 	FinishReason *string `json:"finish_reason"`
+	// StopReason 扩展字段（同 vLLM）：命中的 stop 序列
+	StopReason string `json:"stop_reason,omitempty"`
 }
 
 type OAIMsg struct {
@@ -93,12 +113,20 @@ type OAIMsg struct {
 	Content          string        `json:"content,omitempty"`
 	ToolCalls        []OAIToolCall `json:"tool_calls,omitempty"`
 	ReasoningContent string        `json:"reasoning_content,omitempty"`
+	// ThinkingBlocks 扩展字段：完整的 thinking 块（带 signature），客户端可在后续请求中原样回传
+	ThinkingBlocks []ContentBlock `json:"thinking_blocks,omitempty"`
 }
 
 type OAIUsage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens        int                  `json:"prompt_tokens"`
+	CompletionTokens    int                  `json:"completion_tokens"`
+	TotalTokens         int                  `json:"total_tokens"`
+	PromptTokensDetails *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+type PromptTokensDetails struct {
+	CachedTokens        int `json:"cached_tokens"`
+	CacheCreationTokens int `json:"cache_creation_tokens,omitempty"` // 扩展字段：写入缓存的 token 数
 }
 
 // --- Anthropic Types ---
@@ -113,6 +141,13 @@ type AnthropicRequest struct {
 	Stream      bool            `json:"stream"`
 	Tools       []AnthropicTool `json:"tools,omitempty"`
 	ToolChoice  json.RawMessage `json:"tool_choice,omitempty"`
+	Thinking    *Thinking       `json:"thinking,omitempty"`
+	StopSeqs    []string        `json:"stop_sequences,omitempty"`
+}
+
+type Thinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
 }
 
 type AnthropicMsg struct {
@@ -129,6 +164,17 @@ type ContentBlock struct {
 	ToolUseID string          `json:"tool_use_id,omitempty"`
 	Content   json.RawMessage `json:"content,omitempty"`
 	Thinking  string          `json:"thinking,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+	Data      string          `json:"data,omitempty"` // redacted_thinking 的加密内容
+	IsError   bool            `json:"is_error,omitempty"`
+	Source    *ImageSource    `json:"source,omitempty"`
+}
+
+type ImageSource struct {
+	Type      string `json:"type"` // base64 或 url
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
 }
 
 type AnthropicTool struct {
@@ -138,18 +184,21 @@ type AnthropicTool struct {
 }
 
 type AnthropicResponse struct {
-	ID         string          `json:"id"`
-	Type       string          `json:"type"`
-	Role       string          `json:"role"`
-	Content    []ContentBlock  `json:"content"`
-	Model      string          `json:"model"`
-	StopReason string          `json:"stop_reason"`
-	Usage      *AnthropicUsage `json:"usage,omitempty"`
+	ID           string          `json:"id"`
+	Type         string          `json:"type"`
+	Role         string          `json:"role"`
+	Content      []ContentBlock  `json:"content"`
+	Model        string          `json:"model"`
+	StopReason   string          `json:"stop_reason"`
+	StopSequence string          `json:"stop_sequence,omitempty"`
+	Usage        *AnthropicUsage `json:"usage,omitempty"`
 }
 
 type AnthropicUsage struct {
-	InputTokens  int `json:"input_tokens"`
-	OutputTokens int `json:"output_tokens"`
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
 }
 
 // --- Stream State ---
@@ -160,4 +209,20 @@ type StreamState struct {
 	ToolName  string
 	ToolArgs  string
 	HasTool   bool
+
+	BlockType      string // 当前内容块类型
+	Thinking       string // 当前 thinking 块累计的内容
+	Signature      string
+	ThinkingBlocks []ContentBlock
+	ToolIDs        []string
+	JSONBlock      bool // 当前块是 response_format 合成的工具调用，参数作为文本输出
+
+	// Structured 请求带 response_format：文字先暂存在 PendingText，调用了合成工具时丢弃，
+	// 否则在 message_delta 时发出
+	Structured   bool
+	PendingText  string
+	SawJSONBlock bool
+
+	Usage        AnthropicUsage // message_start 和 message_delta 累计的用量
+	IncludeUsage bool           // stream_options.include_usage：结束时单独发一个只有 usage 的 chunk
 }
@@ -10,6 +10,31 @@ type ModelRoute struct {
 	From    string `json:"from"`
 	To      string `json:"to"`
 	Enabled bool   `json:"enabled"`
+	// Regex 为 true 时 From 按正则整串匹配，To 可用 $1 / ${name} 引用分组；
+	// 否则 From 为通配符，To 中的 * 依次替换为 From 里 * 匹配到的内容
+	Regex bool `json:"regex,omitempty"`
+	// Strategy 同一模型多个 provider 时的选择策略：weighted（默认）、round_robin、
+	// least_outstanding、latency、priority、cheapest；多条路由取值不同时以第一个非空的为准
+	Strategy string `json:"strategy,omitempty"`
+	// Priority 用于 priority 策略，数值小的层级优先，同层级内按权重
+	Priority int `json:"priority,omitempty"`
+	// MaxLatencyMs 用于 cheapest 策略，首字节延迟超过该值的 provider 不参与比价
+	MaxLatencyMs int `json:"max_latency_ms,omitempty"`
+	// Shadow 按采样率把请求异步镜像到影子 provider，只记录结果用于对比
+	Shadow *ShadowConfig `json:"shadow,omitempty"`
+	// Canary 灰度切换目标模型：Percent% 的请求改用 Canary.To
+	Canary *CanaryConfig `json:"canary,omitempty"`
+}
+
+type CanaryConfig struct {
+	To      string  `json:"to"`      // 灰度目标模型，规则同 To
+	Percent float64 `json:"percent"` // 灰度流量百分比 0-100
+}
+
+type ShadowConfig struct {
+	Provider   string  `json:"provider"`        // 影子 provider ID
+	Model      string  `json:"model,omitempty"` // 影子模型，空=与主路由目标模型相同
+	SampleRate float64 `json:"sample_rate"`     // 采样比例 0-1
 }
 
 type Provider struct {
@@ -21,13 +46,118 @@ type Provider struct {
 	Weight  int          `json:"weight"`
 	Timeout int          `json:"timeout"`
 	Models  []ModelRoute `json:"models"`
+	// 主动健康检查：间隔秒数（0=不检查）；探测模型为空时探测所有已启用路由的目标模型
+	HealthCheckInterval int    `json:"health_check_interval,omitempty"`
+	HealthCheckModel    string `json:"health_check_model,omitempty"`
+	// Prices 上游模型价格表，键为目标模型名（支持通配符）
+	Prices map[string]ModelPrice `json:"prices,omitempty"`
+	// PromptCache 为 true 时自动给 Anthropic 请求插入 cache_control 断点
+	PromptCache bool `json:"prompt_cache,omitempty"`
+}
+
+// ModelPrice 每百万 token 的价格；缓存读写价格为 0 时按输入价格计
+type ModelPrice struct {
+	Input      float64 `json:"input"`
+	Output     float64 `json:"output"`
+	CacheRead  float64 `json:"cache_read,omitempty"`
+	CacheWrite float64 `json:"cache_write,omitempty"`
+}
+
+// ModelCapability 上游模型能力，用于限制 max_tokens、规范化参数，并在 /v1/models 中展示；
+// 布尔项未设置时视为支持
+type ModelCapability struct {
+	ContextWindow     int   `json:"context_window,omitempty"`
+	MaxOutputTokens   int   `json:"max_output_tokens,omitempty"`
+	Thinking          *bool `json:"thinking,omitempty"`
+	Vision            *bool `json:"vision,omitempty"`
+	Tools             *bool `json:"tools,omitempty"`
+	ExclusiveSampling bool  `json:"exclusive_sampling,omitempty"` // temperature 和 top_p 只能设置一个
+}
+
+// BreakerConfig 熔断参数，0 值使用默认
+type BreakerConfig struct {
+	FailureThreshold int     `json:"failure_threshold,omitempty"` // 连续失败多少次熔断，默认 5
+	ErrorRate        float64 `json:"error_rate,omitempty"`        // 最近窗口内错误率超过该值熔断，0=不按错误率
+	WindowSize       int     `json:"window_size,omitempty"`       // 错误率统计的最近请求数，默认 20
+	Cooldown         int     `json:"cooldown,omitempty"`          // 熔断后冷却秒数，之后放行一个探测请求，默认 30
+}
+
+// RetryConfig 上游失败后在同一 provider 上的重试参数，0 值使用默认
+type RetryConfig struct {
+	MaxAttempts int `json:"max_attempts,omitempty"`  // 每个 provider 最多尝试次数（含首次），默认 1 即不重试
+	BaseDelayMs int `json:"base_delay_ms,omitempty"` // 指数退避的初始间隔，默认 500
+	MaxDelayMs  int `json:"max_delay_ms,omitempty"`  // 单次等待上限，Retry-After 超过该值时直接换 provider，默认 10000
+	BudgetMs    int `json:"budget_ms,omitempty"`     // 单个客户端请求累计等待上限，默认 30000
+}
+
+// HedgingConfig 非流式请求的对冲：主请求迟迟没有返回响应头时，向另一个 provider 发同样的请求，取先完成的
+type HedgingConfig struct {
+	Enabled    bool    `json:"enabled"`
+	Percentile float64 `json:"percentile,omitempty"`   // 按主 provider 首字节延迟的该分位数决定对冲时机，默认 0.95
+	MinDelayMs int     `json:"min_delay_ms,omitempty"` // 对冲等待下限，样本不足时也使用该值，默认 2000
+}
+
+// ImageConfig 图片内容转换给 Anthropic 时的处理方式
+type ImageConfig struct {
+	Fetch    bool `json:"fetch"`               // 由服务端下载 http(s) 图片转为 base64，否则直接把 url 交给上游
+	MaxBytes int  `json:"max_bytes,omitempty"` // 单张图片大小上限，默认 5MB
+}
+
+// ResponseFormatConfig 结构化输出的校验，默认关闭
+type ResponseFormatConfig struct {
+	Validate bool `json:"validate"` // 非流式响应按 response_format 校验 JSON 和 schema，不符合时返回 502
+}
+
+// RoutingRule 按请求特征路由，按顺序匹配，第一条命中且有可用 provider 的规则生效；
+// 所有条件都是可选的，未设置的条件不参与匹配
+type RoutingRule struct {
+	Name            string            `json:"name"`
+	Enabled         bool              `json:"enabled"`
+	Models          []string          `json:"models,omitempty"` // 请求模型名通配符
+	HasTools        *bool             `json:"has_tools,omitempty"`
+	HasImages       *bool             `json:"has_images,omitempty"`
+	Stream          *bool             `json:"stream,omitempty"`
+	MinPromptTokens int               `json:"min_prompt_tokens,omitempty"` // 估算的提示词 token 数
+	MaxPromptTokens int               `json:"max_prompt_tokens,omitempty"`
+	APIKeys         []string          `json:"api_keys,omitempty"`  // 发起请求使用的访问密钥
+	Headers         map[string]string `json:"headers,omitempty"`   // 请求头，值支持通配符
+	Providers       []string          `json:"providers,omitempty"` // 目标 provider ID，空=沿用模型映射匹配到的 provider
+	Model           string            `json:"model,omitempty"`     // 目标模型，空=沿用各 provider 的模型映射
+}
+
+// ModelAlias 虚拟模型：解析为真实模型并强制覆盖部分请求参数，会出现在 /v1/models 中
+type ModelAlias struct {
+	Name           string          `json:"name"`
+	Model          string          `json:"model"`                     // 实际模型名，继续按模型映射路由
+	ThinkingBudget int             `json:"thinking_budget,omitempty"` // 开启 extended thinking 的 budget_tokens
+	Temperature    *float64        `json:"temperature,omitempty"`     // 开启 thinking 时忽略
+	MaxTokens      int             `json:"max_tokens,omitempty"`
+	SystemPrefix   string          `json:"system_prefix,omitempty"` // 加在系统提示词最前面
+	ToolChoice     json.RawMessage `json:"tool_choice,omitempty"`   // OpenAI 格式
+}
+
+// AffinityConfig 会话粘性：同一会话尽量固定到同一 provider，以命中 prompt cache
+type AffinityConfig struct {
+	Enabled bool   `json:"enabled"`
+	Header  string `json:"header,omitempty"` // 客户端会话头，默认 x-session-id；没有该头时按 system + 首条 user 消息计算
 }
 
 type Config struct {
-	Port          int        `json:"port"`
-	APIKey        string     `json:"api_key"`
-	AdminPassword string     `json:"admin_password"`
-	Providers     []Provider `json:"providers"`
+	Port            int                  `json:"port"`
+	APIKey          string               `json:"api_key"`
+	ExtraAPIKeys    []string             `json:"extra_api_keys,omitempty"` // 额外的访问密钥，可在路由规则中区分调用方
+	AdminPassword   string               `json:"admin_password"`
+	Providers       []Provider           `json:"providers"`
+	CircuitBreaker  BreakerConfig        `json:"circuit_breaker"`
+	SessionAffinity AffinityConfig       `json:"session_affinity"`
+	Retry           RetryConfig          `json:"retry"`
+	Hedging         HedgingConfig        `json:"hedging"`
+	Images          ImageConfig          `json:"images"`
+	ResponseFormat  ResponseFormatConfig `json:"response_format"`
+	RoutingRules    []RoutingRule        `json:"routing_rules,omitempty"`
+	Aliases         []ModelAlias         `json:"aliases,omitempty"`
+	// Capabilities 模型能力表，键为上游模型名（支持通配符），覆盖内置的能力表
+	Capabilities map[string]ModelCapability `json:"capabilities,omitempty"`
 }
 
 var (
@@ -10,6 +10,7 @@ import (
 
 	"cursor-api-2-claude/internal/config"
 	"cursor-api-2-claude/internal/middleware"
+	"cursor-api-2-claude/internal/proxy"
 
 	"github.com/gin-gonic/gin"
 )
@@ -81,6 +82,10 @@ func PutConfig(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
 		return
 	}
+	if err := proxy.ValidateRoutes(cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err := config.Set(cfg); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "save failed"})
 		return
@@ -88,6 +93,44 @@ func PutConfig(c *gin.Context) {
 	c.JSON(http.StatusOK, config.Get())
 }
 
+func GetBreakers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"breakers": proxy.Breakers()})
+}
+
+func GetStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"providers": proxy.Stats()})
+}
+
+func GetShadow(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"records": proxy.ShadowRecords()})
+}
+
+func GetCanaries(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"canaries": proxy.Canaries()})
+}
+
+func PutCanary(c *gin.Context) {
+	var req struct {
+		Provider string  `json:"provider"`
+		From     string  `json:"from"`
+		To       string  `json:"to"`
+		Percent  float64 `json:"percent"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+		return
+	}
+	if err := proxy.SetCanary(req.Provider, req.From, req.To, req.Percent); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"canaries": proxy.Canaries()})
+}
+
+func GetHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"providers": proxy.Health()})
+}
+
 func TestProvider(c *gin.Context) {
 	var p config.Provider
 	if err := c.ShouldBindJSON(&p); err != nil {
@@ -179,72 +222,12 @@ func TestModel(c *gin.Context) {
 		return
 	}
 
-	client := &http.Client{Timeout: 15 * time.Second}
-	start := time.Now()
-	var httpReq *http.Request
-
-	switch req.Provider.Type {
-	case "anthropic":
-		body, _ := json.Marshal(map[string]any{
-			"model":      req.Model,
-			"max_tokens": 1,
-			"messages":   []map[string]string{{"role": "user", "content": "Hi"}},
-		})
-		httpReq, _ = http.NewRequest("POST", req.Provider.BaseURL+"/v1/messages", bytes.NewReader(body))
-		httpReq.Header.Set("x-api-key", req.Provider.APIKey)
-		httpReq.Header.Set("anthropic-version", "2023-06-01")
-		httpReq.Header.Set("Content-Type", "application/json")
-	default:
-		body, _ := json.Marshal(map[string]any{
-			"model":      req.Model,
-			"max_tokens": 1,
-			"messages":   []map[string]string{{"role": "user", "content": "Hi"}},
-		})
-		httpReq, _ = http.NewRequest("POST", req.Provider.BaseURL+"/v1/chat/completions", bytes.NewReader(body))
-		httpReq.Header.Set("Authorization", "Bearer "+req.Provider.APIKey)
-		httpReq.Header.Set("Content-Type", "application/json")
-	}
-
-	resp, err := client.Do(httpReq)
-	latency := time.Since(start).Milliseconds()
-	if err != nil {
-		c.JSON(http.StatusOK, gin.H{"ok": false, "error": err.Error(), "latency_ms": latency})
-		return
-	}
-	defer resp.Body.Close()
-	respBody, _ := io.ReadAll(resp.Body)
-
-	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
-
-	// Try to extract reply text
-	var reply string
-	if req.Provider.Type == "anthropic" {
-		var ar struct {
-			Content []struct {
-				Text string `json:"text"`
-			} `json:"content"`
-		}
-		if json.Unmarshal(respBody, &ar) == nil && len(ar.Content) > 0 {
-			reply = ar.Content[0].Text
-		}
-	} else {
-		var or struct {
-			Choices []struct {
-				Message struct {
-					Content string `json:"content"`
-				} `json:"message"`
-			} `json:"choices"`
-		}
-		if json.Unmarshal(respBody, &or) == nil && len(or.Choices) > 0 {
-			reply = or.Choices[0].Message.Content
-		}
-	}
-
+	res := proxy.Probe(req.Provider, req.Model, 15*time.Second)
 	c.JSON(http.StatusOK, gin.H{
-		"ok":         ok,
-		"status":     resp.StatusCode,
-		"latency_ms": latency,
-		"reply":      reply,
-		"error":      func() string { if !ok { return string(respBody) }; return "" }(),
+		"ok":         res.OK,
+		"status":     res.Status,
+		"latency_ms": res.LatencyMs,
+		"reply":      res.Reply,
+		"error":      res.Error,
 	})
 }
@@ -1,13 +1,11 @@
 package handler
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"cursor-api-2-claude/internal/adapter"
@@ -19,6 +17,7 @@ import (
 
 func ChatCompletions(c *gin.Context) {
 	cfg := config.Get()
+	c.Request = proxy.WithRetryBudget(c.Request)
 
 	body, _ := io.ReadAll(c.Request.Body)
 	log.Printf("[DEBUG] ===== Raw Request =====\n%s", string(body))
@@ -30,59 +29,78 @@ func ChatCompletions(c *gin.Context) {
 	}
 	json.Unmarshal(body, &probe)
 
-	targetModel, providers := proxy.ResolveModel(probe.Model, cfg)
-	if targetModel == "" || len(providers) == 0 {
+	if alias, ok := proxy.FindAlias(probe.Model, cfg); ok {
+		body = proxy.ApplyAlias(body, alias, len(probe.System) > 0)
+		log.Printf("[alias] %s -> %s", probe.Model, alias.Model)
+	}
+
+	routes := proxy.Resolve(proxy.ExtractFeatures(c.Request, body, c.GetString("api_key")), cfg)
+	if len(routes) == 0 {
 		log.Printf("[400] no provider for model: %s", probe.Model)
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("no provider for model %s", probe.Model)})
 		return
 	}
 
-	provider := proxy.WeightedSelect(providers)
-	log.Printf("[proxy] %s -> %s (provider: %s)", probe.Model, targetModel, provider.ID)
-	timeout := time.Duration(provider.Timeout) * time.Second
-	if timeout == 0 {
-		timeout = 300 * time.Second
+	var req adapter.OAIRequest
+	reqErr := json.Unmarshal(body, &req)
+	// 响应里保留客户端请求的模型名（可能是别名）
+	req.Model = probe.Model
+	if reqErr == nil && len(probe.System) == 0 {
+		proxy.InlineImages(c.Request, &req, routes)
 	}
 
-	isNativeAnthropic := provider.Type == "anthropic" && len(probe.System) > 0
+	attempt := func(w http.ResponseWriter, r *http.Request, rt proxy.Route) error {
+		provider, targetModel := rt.Provider, rt.Model
+		log.Printf("[proxy] %s -> %s (provider: %s)", probe.Model, targetModel, provider.ID)
+		timeout := proxy.Timeout(provider)
+
+		isNativeAnthropic := provider.Type == "anthropic" && len(probe.System) > 0
+
+		if isNativeAnthropic {
+			// Cursor 发的就是 Anthropic 原生格式，直接透传，只替换 model
+			var raw map[string]json.RawMessage
+			json.Unmarshal(body, &raw)
+			modelJSON, _ := json.Marshal(targetModel)
+			raw["model"] = modelJSON
+			proxy.NormalizeAnthropicRaw(raw, targetModel)
+			newBody, _ := json.Marshal(raw)
+			log.Printf("[DEBUG] ===== Anthropic Passthrough Request =====\n%s", string(newBody))
+			return proxy.ProxyAnthropicRaw(w, r, newBody, provider, probe.Model, timeout)
+		}
 
-	if isNativeAnthropic {
-		// Cursor 发的就是 Anthropic 原生格式，直接透传，只替换 model
-		var raw map[string]json.RawMessage
-		json.Unmarshal(body, &raw)
-		modelJSON, _ := json.Marshal(targetModel)
-		raw["model"] = modelJSON
-		// 确保 max_tokens 足够
-		var maxTokens int
-		if mt, ok := raw["max_tokens"]; ok {
-			json.Unmarshal(mt, &maxTokens)
+		if reqErr != nil {
+			log.Printf("[400] invalid request body: %v, body: %s", reqErr, string(body[:min(len(body), 200)]))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(gin.H{"error": "invalid request: " + reqErr.Error()})
+			return nil
 		}
-		if maxTokens < 8192 {
-			raw["max_tokens"], _ = json.Marshal(8192)
+
+		switch provider.Type {
+		case "anthropic":
+			return proxy.ProxyAnthropic(w, r, req, provider, targetModel, timeout)
+		default:
+			return proxy.ProxyOpenAI(w, r, body, req, provider, targetModel, timeout)
 		}
-		newBody, _ := json.Marshal(raw)
-		log.Printf("[DEBUG] ===== Anthropic Passthrough Request =====\n%s", string(newBody))
-		proxy.ProxyAnthropicRaw(c.Writer, c.Request, newBody, provider, probe.Model, timeout)
-		return
 	}
 
-	var req adapter.OAIRequest
-	if err := json.Unmarshal(body, &req); err != nil {
-		log.Printf("[400] invalid request body: %v, body: %s", err, string(body[:min(len(body), 200)]))
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
-		return
-	}
+	proxy.Shadow(c.Request, probe.Model, routes, attempt)
 
-	switch provider.Type {
-	case "anthropic":
-		proxy.ProxyAnthropic(c.Writer, c.Request, req, provider, targetModel, timeout)
-	default:
-		proxy.ProxyOpenAI(c.Writer, c.Request, body, req, provider, targetModel, timeout)
+	affinityKey := proxy.AffinityKey(c.Request, body)
+	var err error
+	if proxy.HedgingEnabled(routes, req.Stream) {
+		err = proxy.Hedge(c.Writer, c.Request, routes, affinityKey, attempt)
+	} else {
+		err = proxy.Failover(c.Writer, c.Request, routes, affinityKey, attempt)
+	}
+	if err != nil {
+		proxy.WriteError(c.Writer, err)
 	}
 }
 
 func Messages(c *gin.Context) {
 	cfg := config.Get()
+	c.Request = proxy.WithRetryBudget(c.Request)
 
 	body, _ := io.ReadAll(c.Request.Body)
 	var raw struct {
@@ -90,95 +108,123 @@ func Messages(c *gin.Context) {
 	}
 	json.Unmarshal(body, &raw)
 
-	targetModel, providers := proxy.ResolveModel(raw.Model, cfg)
-	if targetModel == "" || len(providers) == 0 {
+	if alias, ok := proxy.FindAlias(raw.Model, cfg); ok {
+		body = proxy.ApplyAlias(body, alias, true)
+		log.Printf("[alias] %s -> %s", raw.Model, alias.Model)
+	}
+
+	routes := proxy.Resolve(proxy.ExtractFeatures(c.Request, body, c.GetString("api_key")), cfg)
+	if len(routes) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("no provider for model %s", raw.Model)})
 		return
 	}
 
-	provider := proxy.WeightedSelect(providers)
-
-	var full map[string]json.RawMessage
-	json.Unmarshal(body, &full)
-	modelJSON, _ := json.Marshal(targetModel)
-	full["model"] = modelJSON
-	newBody, _ := json.Marshal(full)
-
-	timeout := time.Duration(provider.Timeout) * time.Second
-	if timeout == 0 {
-		timeout = 300 * time.Second
+	attempt := func(w http.ResponseWriter, r *http.Request, rt proxy.Route) error {
+		var full map[string]json.RawMessage
+		json.Unmarshal(body, &full)
+		modelJSON, _ := json.Marshal(rt.Model)
+		full["model"] = modelJSON
+		newBody, _ := json.Marshal(full)
+		log.Printf("[proxy] %s -> %s (provider: %s)", raw.Model, rt.Model, rt.Provider.ID)
+		if rt.Provider.Type != "anthropic" {
+			return proxy.ProxyMessagesOpenAI(w, r, newBody, rt.Provider, rt.Model, raw.Model, proxy.Timeout(rt.Provider))
+		}
+		return proxy.ProxyMessages(w, r, newBody, rt.Provider, proxy.Timeout(rt.Provider))
 	}
 
-	client := &http.Client{Timeout: timeout}
-	url := strings.TrimRight(provider.BaseURL, "/") + "/v1/messages"
-	httpReq, _ := http.NewRequestWithContext(c.Request.Context(), "POST", url, bytes.NewReader(newBody))
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("x-api-key", provider.APIKey)
-	httpReq.Header.Set("anthropic-version", "2023-06-01")
+	proxy.Shadow(c.Request, raw.Model, routes, attempt)
 
-	resp, err := client.Do(httpReq)
+	err := proxy.Failover(c.Writer, c.Request, routes, proxy.AffinityKey(c.Request, body), attempt)
 	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
-		return
-	}
-	defer resp.Body.Close()
-
-	for k, vs := range resp.Header {
-		for _, v := range vs {
-			c.Writer.Header().Add(k, v)
-		}
-	}
-	c.Writer.WriteHeader(resp.StatusCode)
-
-	isStream := strings.Contains(resp.Header.Get("Content-Type"), "event-stream")
-	if isStream {
-		rc := http.NewResponseController(c.Writer)
-		rc.SetWriteDeadline(time.Time{})
-		buf := make([]byte, 32*1024)
-		for {
-			n, err := resp.Body.Read(buf)
-			if n > 0 {
-				c.Writer.Write(buf[:n])
-				c.Writer.Flush()
-			}
-			if err != nil {
-				break
-			}
-		}
-	} else {
-		io.Copy(c.Writer, resp.Body)
+		proxy.WriteAnthropicError(c.Writer, err)
 	}
 }
 
 func Models(c *gin.Context) {
 	cfg := config.Get()
+	type capabilities struct {
+		Thinking bool `json:"thinking"`
+		Vision   bool `json:"vision"`
+		Tools    bool `json:"tools"`
+	}
 	type model struct {
 		ID      string `json:"id"`
 		Object  string `json:"object"`
 		Created int64  `json:"created"`
 		OwnedBy string `json:"owned_by"`
+		// 扩展字段：上游模型能力，未知时不返回
+		ContextWindow   int           `json:"context_window,omitempty"`
+		MaxOutputTokens int           `json:"max_output_tokens,omitempty"`
+		Capabilities    *capabilities `json:"capabilities,omitempty"`
+	}
+	withCaps := func(m model, target string) model {
+		if c, ok := proxy.LookupCapability(target); ok {
+			m.ContextWindow = c.ContextWindow
+			m.MaxOutputTokens = c.MaxOutputTokens
+			m.Capabilities = &capabilities{
+				Thinking: c.Thinking == nil || *c.Thinking,
+				Vision:   c.Vision == nil || *c.Vision,
+				Tools:    c.Tools == nil || *c.Tools,
+			}
+		}
+		return m
 	}
 	seen := map[string]bool{}
 	var models []model
 	for _, p := range cfg.Providers {
 		for _, m := range p.Models {
-			if m.Enabled && !seen[m.From] {
+			if m.Enabled && !m.Regex && !seen[m.From] {
 				seen[m.From] = true
-				models = append(models, model{
+				models = append(models, withCaps(model{
 					ID:      m.From,
 					Object:  "model",
 					Created: time.Now().Unix(),
 					OwnedBy: "proxy",
-				})
+				}, m.To))
 			}
 		}
 	}
+	for _, a := range cfg.Aliases {
+		if a.Model != "" && !seen[a.Name] {
+			seen[a.Name] = true
+			models = append(models, withCaps(model{
+				ID:      a.Name,
+				Object:  "model",
+				Created: time.Now().Unix(),
+				OwnedBy: "proxy",
+			}, aliasTarget(cfg, a.Model)))
+		}
+	}
 	if models == nil {
 		models = []model{}
 	}
 	c.JSON(http.StatusOK, gin.H{"object": "list", "data": models})
 }
 
+// aliasTarget 找到别名实际模型对应的第一个上游模型名，用于查询能力
+func aliasTarget(cfg config.Config, name string) string {
+	if routes := proxy.ResolveModel(name, cfg); len(routes) > 0 {
+		return routes[0].Model
+	}
+	return name
+}
+
+// Health 默认只表示进程存活；?mode=ready 时至少有一个可用 provider 才返回 200
 func Health(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	if c.Query("mode") != "ready" {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+	providers := proxy.Health()
+	ready := false
+	summary := map[string]bool{}
+	for _, p := range providers {
+		summary[p.Provider] = p.Available
+		ready = ready || p.Available
+	}
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{"status": status, "providers": summary})
 }
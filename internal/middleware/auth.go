@@ -52,11 +52,15 @@ func APIKeyAuth() gin.HandlerFunc {
 		}
 		auth := c.GetHeader("Authorization")
 		xKey := c.GetHeader("x-api-key")
-		if auth != "Bearer "+cfg.APIKey && xKey != cfg.APIKey {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-			return
+		for _, key := range append([]string{cfg.APIKey}, cfg.ExtraAPIKeys...) {
+			if key != "" && (auth == "Bearer "+key || xKey == key) {
+				// 路由规则按调用方密钥匹配
+				c.Set("api_key", key)
+				c.Next()
+				return
+			}
 		}
-		c.Next()
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 	}
 }
 
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"net/http"
+
+	"cursor-api-2-claude/internal/config"
+)
+
+// AffinityKey 计算请求的会话键，未开启会话粘性时返回空串。
+// 优先使用客户端提供的会话头，否则用 system 和第一条 user 消息的哈希，
+// 同一个对话后续轮次这两部分不变。
+func AffinityKey(r *http.Request, body []byte) string {
+	ac := config.Get().SessionAffinity
+	if !ac.Enabled {
+		return ""
+	}
+	header := ac.Header
+	if header == "" {
+		header = "x-session-id"
+	}
+	if v := r.Header.Get(header); v != "" {
+		return "h:" + v
+	}
+
+	var probe struct {
+		System   json.RawMessage `json:"system"`
+		Messages []struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	if json.Unmarshal(body, &probe) != nil {
+		return ""
+	}
+	h := sha256.New()
+	h.Write(probe.System)
+	found := false
+	for _, m := range probe.Messages {
+		switch m.Role {
+		case "system", "developer":
+			h.Write(m.Content)
+		case "user":
+			h.Write(m.Content)
+			found = true
+		}
+		if found {
+			break
+		}
+	}
+	if !found && len(probe.System) == 0 {
+		return ""
+	}
+	return "b:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// affinityIndex 用加权 rendezvous 哈希选择 provider：候选集合变化时只有落在变化
+// provider 上的会话会迁移，provider 恢复后会话也会回到原来的位置。
+func affinityIndex(routes []Route, key string) int {
+	best, bestScore := 0, math.Inf(-1)
+	for i, rt := range routes {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(rt.Provider.ID))
+		// 映射到 (0,1) 区间
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		weight := math.Max(float64(rt.Provider.Weight), 1)
+		score := -weight / math.Log(u)
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
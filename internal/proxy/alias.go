@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/json"
+
+	"cursor-api-2-claude/internal/adapter"
+	"cursor-api-2-claude/internal/config"
+)
+
+func FindAlias(model string, c config.Config) (config.ModelAlias, bool) {
+	for _, a := range c.Aliases {
+		if a.Name == model && a.Model != "" {
+			return a, true
+		}
+	}
+	return config.ModelAlias{}, false
+}
+
+// ApplyAlias 把别名的模型和预设参数写入请求体，anthropic 表示请求体为 Anthropic 原生格式
+func ApplyAlias(body []byte, a config.ModelAlias, anthropic bool) []byte {
+	var raw map[string]json.RawMessage
+	if json.Unmarshal(body, &raw) != nil {
+		return body
+	}
+
+	raw["model"], _ = json.Marshal(a.Model)
+	if a.MaxTokens > 0 {
+		raw["max_tokens"], _ = json.Marshal(a.MaxTokens)
+		delete(raw, "max_completion_tokens")
+	}
+	if a.Temperature != nil {
+		raw["temperature"], _ = json.Marshal(*a.Temperature)
+	}
+	if len(a.ToolChoice) > 0 {
+		if !anthropic {
+			raw["tool_choice"] = a.ToolChoice
+		} else if choice, _ := adapter.ToolChoiceToAnthropic(a.ToolChoice, nil); choice != nil {
+			raw["tool_choice"] = choice
+		}
+	}
+	if a.SystemPrefix != "" {
+		prependSystem(raw, a.SystemPrefix, anthropic)
+	}
+	if a.ThinkingBudget > 0 {
+		// thinking 不支持修改 temperature / top_p
+		delete(raw, "temperature")
+		delete(raw, "top_p")
+		if anthropic {
+			// max_tokens 必须大于 budget_tokens
+			raw["thinking"], _ = json.Marshal(adapter.Thinking{Type: "enabled", BudgetTokens: a.ThinkingBudget})
+			var maxTokens int
+			json.Unmarshal(raw["max_tokens"], &maxTokens)
+			if maxTokens <= a.ThinkingBudget {
+				raw["max_tokens"], _ = json.Marshal(a.ThinkingBudget + adapter.DefaultMaxTokens)
+			}
+		} else {
+			// thinking 扩展字段保留精确预算，转到 Anthropic 时优先于 reasoning_effort；
+			// reasoning_effort 给 OpenAI provider 用，ProxyOpenAI 转发前会去掉 thinking
+			raw["thinking"], _ = json.Marshal(adapter.Thinking{Type: "enabled", BudgetTokens: a.ThinkingBudget})
+			raw["reasoning_effort"], _ = json.Marshal(adapter.EffortFromBudget(a.ThinkingBudget))
+		}
+	}
+
+	newBody, err := json.Marshal(raw)
+	if err != nil {
+		return body
+	}
+	return newBody
+}
+
+func prependSystem(raw map[string]json.RawMessage, prefix string, anthropic bool) {
+	if !anthropic {
+		var msgs []json.RawMessage
+		json.Unmarshal(raw["messages"], &msgs)
+		sys, _ := json.Marshal(map[string]string{"role": "system", "content": prefix})
+		raw["messages"], _ = json.Marshal(append([]json.RawMessage{sys}, msgs...))
+		return
+	}
+
+	var s string
+	if len(raw["system"]) == 0 || json.Unmarshal(raw["system"], &s) == nil {
+		if s != "" {
+			s = prefix + "\n\n" + s
+		} else {
+			s = prefix
+		}
+		raw["system"], _ = json.Marshal(s)
+		return
+	}
+	var blocks []json.RawMessage
+	json.Unmarshal(raw["system"], &blocks)
+	block, _ := json.Marshal(adapter.ContentBlock{Type: "text", Text: prefix})
+	raw["system"], _ = json.Marshal(append([]json.RawMessage{block}, blocks...))
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cursor-api-2-claude/internal/config"
+)
+
+const (
+	StrategyWeighted         = "weighted"
+	StrategyRoundRobin       = "round_robin"
+	StrategyLeastOutstanding = "least_outstanding"
+	StrategyLatency          = "latency"
+	StrategyPriority         = "priority"
+	StrategyCheapest         = "cheapest"
+)
+
+const (
+	latencyAlpha   = 0.3 // EWMA 平滑系数
+	latencySamples = 200 // 计算分位数保留的最近样本数
+	// 失败请求计入 EWMA 的最小延迟，避免快速失败的 provider 显得最快
+	latencyFailurePenalty = 10 * time.Second
+	// 延迟相关策略分给非最优 provider 的探索流量比例，
+	// 否则一次变慢的 provider 拿不到新样本，EWMA 永远不会恢复
+	latencyExploreRate = 0.05
+)
+
+// providerStats 是负载均衡用到的实时统计
+type providerStats struct {
+	outstanding int
+	latencyMs   float64   // 首字节延迟的 EWMA（失败按惩罚值计入）
+	latencyN    int       // 计入 EWMA 的次数，0 表示还没有数据
+	samples     []float64 // 成功请求的首字节延迟，用于对冲的分位数
+	requests    int
+	failures    int
+	usage       Usage
+	cost        float64
+}
+
+var (
+	stats      = map[string]*providerStats{}
+	rrCounters = map[string]int{}
+	statsMu    sync.Mutex
+)
+
+func getStatsLocked(id string) *providerStats {
+	st, ok := stats[id]
+	if !ok {
+		st = &providerStats{}
+		stats[id] = st
+	}
+	return st
+}
+
+func beginRequest(id string) {
+	statsMu.Lock()
+	getStatsLocked(id).outstanding++
+	statsMu.Unlock()
+}
+
+func endRequest(id string, failed bool) {
+	statsMu.Lock()
+	st := getStatsLocked(id)
+	st.outstanding--
+	st.requests++
+	if failed {
+		st.failures++
+	}
+	statsMu.Unlock()
+}
+
+// recordLatency 记录一次请求的首字节延迟。失败的请求按 latencyFailurePenalty 计入 EWMA，
+// 但不进入分位数样本，避免拉高对冲等待时间
+func recordLatency(id string, d time.Duration, failed bool) {
+	if failed {
+		d = max(d, latencyFailurePenalty)
+	}
+	ms := float64(d.Milliseconds())
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	st := getStatsLocked(id)
+	if st.latencyN == 0 {
+		st.latencyMs = ms
+	} else {
+		st.latencyMs = latencyAlpha*ms + (1-latencyAlpha)*st.latencyMs
+	}
+	st.latencyN++
+	if failed {
+		return
+	}
+	st.samples = append(st.samples, ms)
+	if len(st.samples) > latencySamples {
+		st.samples = st.samples[len(st.samples)-latencySamples:]
+	}
+}
+
+// latencyScoresLocked 返回各路由的延迟评分；还没有数据的 provider 取有数据的候选的平均值作为先验，
+// 所有候选都没有数据时都为 0
+func latencyScoresLocked(routes []Route) map[string]float64 {
+	scores := map[string]float64{}
+	var sum float64
+	var n int
+	for _, rt := range routes {
+		if st := getStatsLocked(rt.Provider.ID); st.latencyN > 0 {
+			scores[rt.Provider.ID] = st.latencyMs
+			sum += st.latencyMs
+			n++
+		}
+	}
+	for _, rt := range routes {
+		if _, ok := scores[rt.Provider.ID]; !ok && n > 0 {
+			scores[rt.Provider.ID] = sum / float64(n)
+		}
+	}
+	return scores
+}
+
+// latencyPercentile 返回 provider 首字节延迟的 q 分位数，样本不足 minSamples 时返回 false
+func latencyPercentile(id string, q float64, minSamples int) (time.Duration, bool) {
+	statsMu.Lock()
+	samples := append([]float64(nil), getStatsLocked(id).samples...)
+	statsMu.Unlock()
+	if len(samples) < minSamples || len(samples) == 0 {
+		return 0, false
+	}
+	sort.Float64s(samples)
+	i := int(q * float64(len(samples)-1))
+	return time.Duration(samples[i]) * time.Millisecond, true
+}
+
+func routeStrategy(routes []Route) string {
+	for _, rt := range routes {
+		if rt.Strategy != "" {
+			return rt.Strategy
+		}
+	}
+	return StrategyWeighted
+}
+
+// routesKey 用候选 provider 集合标识一组路由，round_robin 按它轮转
+func routesKey(routes []Route) string {
+	ids := make([]string, len(routes))
+	for i, rt := range routes {
+		ids[i] = rt.Provider.ID
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// selectIndex 按策略从候选中选出一个，rrKey 为 round_robin 的计数键
+func selectIndex(routes []Route, strategy, rrKey string) int {
+	switch strategy {
+	case StrategyRoundRobin:
+		statsMu.Lock()
+		n := rrCounters[rrKey]
+		rrCounters[rrKey] = n + 1
+		statsMu.Unlock()
+		return n % len(routes)
+	case StrategyLeastOutstanding:
+		statsMu.Lock()
+		defer statsMu.Unlock()
+		return weightedAmongBest(routes, func(rt Route) float64 {
+			return float64(getStatsLocked(rt.Provider.ID).outstanding)
+		})
+	case StrategyLatency:
+		statsMu.Lock()
+		defer statsMu.Unlock()
+		scores := latencyScoresLocked(routes)
+		best := weightedAmongBest(routes, func(rt Route) float64 {
+			return scores[rt.Provider.ID]
+		})
+		if exploreLatency() {
+			return weightedExcept(routes, best)
+		}
+		return best
+	case StrategyPriority:
+		return weightedAmongBest(routes, func(rt Route) float64 {
+			return float64(rt.Priority)
+		})
+	case StrategyCheapest:
+		return cheapestIndex(routes)
+	}
+	return weightedIndex(routes)
+}
+
+// weightedAmongBest 取 score 最小的那些路由，再按权重从中选一个
+func weightedAmongBest(routes []Route, score func(Route) float64) int {
+	best := score(routes[0])
+	for _, rt := range routes[1:] {
+		if s := score(rt); s < best {
+			best = s
+		}
+	}
+	var idx []int
+	var tier []Route
+	for i, rt := range routes {
+		if score(rt) == best {
+			idx = append(idx, i)
+			tier = append(tier, rt)
+		}
+	}
+	return idx[weightedIndex(tier)]
+}
+
+// exploreLatency 按 latencyExploreRate 决定本次是否探索非最优 provider
+func exploreLatency() bool {
+	return rand.Float64() < latencyExploreRate
+}
+
+// weightedExcept 在除 skip 以外的路由中按权重选一个；只有一条路由时返回 skip
+func weightedExcept(routes []Route, skip int) int {
+	if len(routes) < 2 {
+		return skip
+	}
+	var idx []int
+	var rest []Route
+	for i, rt := range routes {
+		if i != skip {
+			idx = append(idx, i)
+			rest = append(rest, rt)
+		}
+	}
+	return idx[weightedIndex(rest)]
+}
+
+type ProviderStats struct {
+	Provider    string  `json:"provider"`
+	Outstanding int     `json:"outstanding"`
+	LatencyMs   float64 `json:"latency_ms"`
+	Requests    int     `json:"requests"`
+	Failures    int     `json:"failures"`
+	Usage       Usage   `json:"usage"`
+	Cost        float64 `json:"cost"`
+}
+
+// Stats 返回负载均衡统计
+func Stats() []ProviderStats {
+	c := config.Get()
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	list := []ProviderStats{}
+	for _, p := range c.Providers {
+		st := getStatsLocked(p.ID)
+		list = append(list, ProviderStats{
+			Provider:    p.ID,
+			Outstanding: st.outstanding,
+			LatencyMs:   st.latencyMs,
+			Requests:    st.requests,
+			Failures:    st.failures,
+			Usage:       st.usage,
+			Cost:        st.cost,
+		})
+	}
+	return list
+}
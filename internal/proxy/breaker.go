@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"cursor-api-2-claude/internal/config"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// breaker 根据真实流量被动统计单个 provider 的失败情况
+type breaker struct {
+	state     string
+	failures  int    // 连续失败次数
+	window    []bool // 最近请求结果，true 表示失败
+	openedAt  time.Time
+	probing   bool // half_open 状态下是否已有探测请求在进行
+	lastError string
+}
+
+var (
+	breakers   = map[string]*breaker{}
+	breakersMu sync.Mutex
+)
+
+func breakerSettings() config.BreakerConfig {
+	bc := config.Get().CircuitBreaker
+	if bc.FailureThreshold == 0 {
+		bc.FailureThreshold = 5
+	}
+	if bc.WindowSize == 0 {
+		bc.WindowSize = 20
+	}
+	if bc.Cooldown == 0 {
+		bc.Cooldown = 30
+	}
+	return bc
+}
+
+func getBreakerLocked(id string) *breaker {
+	b, ok := breakers[id]
+	if !ok {
+		b = &breaker{state: breakerClosed}
+		breakers[id] = b
+	}
+	return b
+}
+
+// breakerAvailable 只读判断 provider 当前能否接收请求
+func breakerAvailable(id string) bool {
+	cooldown := time.Duration(breakerSettings().Cooldown) * time.Second
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[id]
+	if !ok {
+		return true
+	}
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) >= cooldown
+	case breakerHalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+// breakerAcquire 在真正发出请求前调用，检查和占用在同一把锁内完成：冷却结束的熔断器在这里转为 half_open，
+// 只有第一个请求拿到探测名额，并发的其它请求返回 false
+func breakerAcquire(id string) bool {
+	cooldown := time.Duration(breakerSettings().Cooldown) * time.Second
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b := getBreakerLocked(id)
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		log.Printf("[breaker] provider %s half-open, sending probe", id)
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+	default:
+		return true
+	}
+	b.probing = true
+	return true
+}
+
+// breakerRelease 请求没有结论（例如客户端断开）时归还探测名额
+func breakerRelease(id string) {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	if b, ok := breakers[id]; ok {
+		b.probing = false
+	}
+}
+
+func breakerRecord(id string, err error) {
+	bc := breakerSettings()
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b := getBreakerLocked(id)
+	failed := err != nil
+	b.probing = false
+
+	b.window = append(b.window, failed)
+	if len(b.window) > bc.WindowSize {
+		b.window = b.window[len(b.window)-bc.WindowSize:]
+	}
+
+	if !failed {
+		if b.state != breakerClosed {
+			log.Printf("[breaker] provider %s recovered, closing", id)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+	trip := b.state == breakerHalfOpen || b.failures >= bc.FailureThreshold
+	if bc.ErrorRate > 0 && len(b.window) >= bc.WindowSize && windowErrorRate(b.window) >= bc.ErrorRate {
+		trip = true
+	}
+	if trip && b.state != breakerOpen {
+		log.Printf("[breaker] provider %s opened after %d consecutive failure(s): %v", id, b.failures, err)
+	}
+	if trip {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func windowErrorRate(window []bool) float64 {
+	if len(window) == 0 {
+		return 0
+	}
+	n := 0
+	for _, f := range window {
+		if f {
+			n++
+		}
+	}
+	return float64(n) / float64(len(window))
+}
+
+type BreakerStatus struct {
+	Provider            string     `json:"provider"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	ErrorRate           float64    `json:"error_rate"`
+	Requests            int        `json:"requests"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+// Breakers 返回所有已配置 provider 的熔断状态
+func Breakers() []BreakerStatus {
+	c := config.Get()
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	list := []BreakerStatus{}
+	for _, p := range c.Providers {
+		st := BreakerStatus{Provider: p.ID, State: breakerClosed}
+		if b, ok := breakers[p.ID]; ok {
+			st.State = b.state
+			st.ConsecutiveFailures = b.failures
+			st.ErrorRate = windowErrorRate(b.window)
+			st.Requests = len(b.window)
+			st.LastError = b.lastError
+			if b.state != breakerClosed {
+				t := b.openedAt
+				st.OpenedAt = &t
+			}
+		}
+		list = append(list, st)
+	}
+	return list
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func resetBreaker(id string) {
+	breakersMu.Lock()
+	delete(breakers, id)
+	breakersMu.Unlock()
+}
+
+func breakerState(id string) string {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	if b, ok := breakers[id]; ok {
+		return b.state
+	}
+	return breakerClosed
+}
+
+// expireCooldown 把熔断时间往前挪，模拟冷却结束
+func expireCooldown(id string) {
+	breakersMu.Lock()
+	breakers[id].openedAt = time.Now().Add(-time.Hour)
+	breakersMu.Unlock()
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	errUpstream := errors.New("boom")
+	threshold := breakerSettings().FailureThreshold
+
+	tests := []struct {
+		name  string
+		steps func(id string)
+		state string
+		avail bool
+	}{
+		{"new provider closed", func(id string) {}, breakerClosed, true},
+		{"failures below threshold stay closed", func(id string) {
+			for i := 0; i < threshold-1; i++ {
+				breakerRecord(id, errUpstream)
+			}
+		}, breakerClosed, true},
+		{"success resets consecutive failures", func(id string) {
+			for i := 0; i < threshold-1; i++ {
+				breakerRecord(id, errUpstream)
+			}
+			breakerRecord(id, nil)
+			breakerRecord(id, errUpstream)
+		}, breakerClosed, true},
+		{"threshold opens", func(id string) {
+			for i := 0; i < threshold; i++ {
+				breakerRecord(id, errUpstream)
+			}
+		}, breakerOpen, false},
+		{"cooldown expired allows probe", func(id string) {
+			for i := 0; i < threshold; i++ {
+				breakerRecord(id, errUpstream)
+			}
+			expireCooldown(id)
+		}, breakerOpen, true},
+		{"probe acquired is half-open and blocks others", func(id string) {
+			for i := 0; i < threshold; i++ {
+				breakerRecord(id, errUpstream)
+			}
+			expireCooldown(id)
+			breakerAcquire(id)
+		}, breakerHalfOpen, false},
+		{"probe success closes", func(id string) {
+			for i := 0; i < threshold; i++ {
+				breakerRecord(id, errUpstream)
+			}
+			expireCooldown(id)
+			breakerAcquire(id)
+			breakerRecord(id, nil)
+		}, breakerClosed, true},
+		{"probe failure reopens", func(id string) {
+			for i := 0; i < threshold; i++ {
+				breakerRecord(id, errUpstream)
+			}
+			expireCooldown(id)
+			breakerAcquire(id)
+			breakerRecord(id, errUpstream)
+		}, breakerOpen, false},
+		{"released probe can be retaken", func(id string) {
+			for i := 0; i < threshold; i++ {
+				breakerRecord(id, errUpstream)
+			}
+			expireCooldown(id)
+			breakerAcquire(id)
+			breakerRelease(id)
+		}, breakerHalfOpen, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := "breaker-test-" + tt.name
+			resetBreaker(id)
+			defer resetBreaker(id)
+			tt.steps(id)
+			if got := breakerState(id); got != tt.state {
+				t.Errorf("state = %s, want %s", got, tt.state)
+			}
+			if got := breakerAvailable(id); got != tt.avail {
+				t.Errorf("available = %v, want %v", got, tt.avail)
+			}
+		})
+	}
+}
+
+func TestBreakerAcquireSingleProbe(t *testing.T) {
+	id := "breaker-test-single-probe"
+	resetBreaker(id)
+	defer resetBreaker(id)
+	for i := 0; i < breakerSettings().FailureThreshold; i++ {
+		breakerRecord(id, errors.New("boom"))
+	}
+	if breakerAcquire(id) {
+		t.Fatal("acquire succeeded during cooldown")
+	}
+	expireCooldown(id)
+
+	const n = 50
+	results := make(chan bool, n)
+	for i := 0; i < n; i++ {
+		go func() { results <- breakerAcquire(id) }()
+	}
+	acquired := 0
+	for i := 0; i < n; i++ {
+		if <-results {
+			acquired++
+		}
+	}
+	if acquired != 1 {
+		t.Errorf("%d concurrent probes acquired, want 1", acquired)
+	}
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"cursor-api-2-claude/internal/config"
+)
+
+const (
+	variantStable = "stable"
+	variantCanary = "canary"
+)
+
+// applyCanary 对配置了灰度的路由按比例改写目标模型
+func applyCanary(rt *Route, m config.ModelRoute, model string) {
+	if m.Canary == nil || m.Canary.To == "" {
+		return
+	}
+	rt.Variant = variantStable
+	if rand.Float64()*100 >= m.Canary.Percent {
+		return
+	}
+	cm := m
+	cm.To = m.Canary.To
+	if to, ok := matchModel(cm, model); ok {
+		rt.Model = to
+		rt.Variant = variantCanary
+	}
+}
+
+type variantStats struct {
+	requests  int
+	failures  int
+	latencyMs float64 // 请求耗时（流式为整个流的时长）的累计值
+}
+
+var (
+	variants   = map[string]*variantStats{} // provider|from|variant -> 统计
+	variantsMu sync.Mutex
+)
+
+func variantKey(providerID, from, variant string) string {
+	return providerID + "|" + from + "|" + variant
+}
+
+func recordVariant(rt Route, d time.Duration, failed bool) {
+	if rt.Variant == "" {
+		return
+	}
+	variantsMu.Lock()
+	defer variantsMu.Unlock()
+	key := variantKey(rt.Provider.ID, rt.From, rt.Variant)
+	st, ok := variants[key]
+	if !ok {
+		st = &variantStats{}
+		variants[key] = st
+	}
+	st.requests++
+	if failed {
+		st.failures++
+	}
+	st.latencyMs += float64(d.Milliseconds())
+}
+
+type VariantStatus struct {
+	Model        string  `json:"model"`
+	Requests     int     `json:"requests"`
+	Failures     int     `json:"failures"`
+	ErrorRate    float64 `json:"error_rate"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+type CanaryStatus struct {
+	Provider string        `json:"provider"`
+	From     string        `json:"from"`
+	Percent  float64       `json:"percent"`
+	Stable   VariantStatus `json:"stable"`
+	Canary   VariantStatus `json:"canary"`
+}
+
+// Canaries 列出所有配置了灰度的路由，稳定版和灰度版的错误率、延迟并排展示
+func Canaries() []CanaryStatus {
+	c := config.Get()
+	variantsMu.Lock()
+	defer variantsMu.Unlock()
+	list := []CanaryStatus{}
+	for _, p := range c.Providers {
+		for _, m := range p.Models {
+			if m.Canary == nil {
+				continue
+			}
+			list = append(list, CanaryStatus{
+				Provider: p.ID,
+				From:     m.From,
+				Percent:  m.Canary.Percent,
+				Stable:   variantStatusLocked(p.ID, m.From, variantStable, m.To),
+				Canary:   variantStatusLocked(p.ID, m.From, variantCanary, m.Canary.To),
+			})
+		}
+	}
+	return list
+}
+
+func variantStatusLocked(providerID, from, variant, model string) VariantStatus {
+	vs := VariantStatus{Model: model}
+	if st, ok := variants[variantKey(providerID, from, variant)]; ok {
+		vs.Requests = st.requests
+		vs.Failures = st.failures
+		if st.requests > 0 {
+			vs.ErrorRate = float64(st.failures) / float64(st.requests)
+			vs.AvgLatencyMs = st.latencyMs / float64(st.requests)
+		}
+	}
+	return vs
+}
+
+// SetCanary 修改某条路由的灰度目标和比例并保存配置；to 为空时保留原目标，percent 为负数时移除灰度
+func SetCanary(providerID, from, to string, percent float64) error {
+	if percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	c := config.Get()
+	for i, p := range c.Providers {
+		if p.ID != providerID {
+			continue
+		}
+		models := append([]config.ModelRoute(nil), p.Models...)
+		for j, m := range models {
+			if m.From != from {
+				continue
+			}
+			if percent < 0 {
+				models[j].Canary = nil
+			} else {
+				canary := config.CanaryConfig{Percent: percent}
+				if m.Canary != nil {
+					canary.To = m.Canary.To
+				}
+				if to != "" {
+					canary.To = to
+				}
+				if canary.To == "" {
+					return fmt.Errorf("canary target model is required")
+				}
+				models[j].Canary = &canary
+			}
+			c.Providers = append([]config.Provider(nil), c.Providers...)
+			c.Providers[i].Models = models
+			if err := ValidateRoutes(c); err != nil {
+				return err
+			}
+			// 比例变了，之前的统计不再有可比性
+			variantsMu.Lock()
+			delete(variants, variantKey(providerID, from, variantStable))
+			delete(variants, variantKey(providerID, from, variantCanary))
+			variantsMu.Unlock()
+			return config.Set(c)
+		}
+		return fmt.Errorf("provider %s has no route %s", providerID, from)
+	}
+	return fmt.Errorf("unknown provider %s", providerID)
+}
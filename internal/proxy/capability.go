@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+
+	"cursor-api-2-claude/internal/adapter"
+	"cursor-api-2-claude/internal/config"
+)
+
+func boolPtr(b bool) *bool { return &b }
+
+// 内置能力表，按顺序匹配，具体的型号写在前面
+var builtinCapabilities = []struct {
+	pattern string
+	cap     config.ModelCapability
+}{
+	{"claude-opus-4-0*", config.ModelCapability{ContextWindow: 200000, MaxOutputTokens: 32000}},
+	{"claude-opus-4-2025*", config.ModelCapability{ContextWindow: 200000, MaxOutputTokens: 32000}},
+	{"claude-opus-4-1*", config.ModelCapability{ContextWindow: 200000, MaxOutputTokens: 32000, ExclusiveSampling: true}},
+	{"claude-opus-4-*", config.ModelCapability{ContextWindow: 200000, MaxOutputTokens: 64000, ExclusiveSampling: true}},
+	{"claude-sonnet-4-5*", config.ModelCapability{ContextWindow: 200000, MaxOutputTokens: 64000, ExclusiveSampling: true}},
+	{"claude-sonnet-4*", config.ModelCapability{ContextWindow: 200000, MaxOutputTokens: 64000}},
+	{"claude-haiku-4-5*", config.ModelCapability{ContextWindow: 200000, MaxOutputTokens: 64000, ExclusiveSampling: true}},
+	{"claude-3-7-sonnet*", config.ModelCapability{ContextWindow: 200000, MaxOutputTokens: 64000}},
+	{"claude-3-5-sonnet*", config.ModelCapability{ContextWindow: 200000, MaxOutputTokens: 8192, Thinking: boolPtr(false)}},
+	{"claude-3-5-haiku*", config.ModelCapability{ContextWindow: 200000, MaxOutputTokens: 8192, Thinking: boolPtr(false)}},
+	{"claude-3-opus*", config.ModelCapability{ContextWindow: 200000, MaxOutputTokens: 4096, Thinking: boolPtr(false)}},
+	{"claude-3-haiku*", config.ModelCapability{ContextWindow: 200000, MaxOutputTokens: 4096, Thinking: boolPtr(false)}},
+}
+
+// LookupCapability 查找上游模型的能力：配置精确匹配 > 配置中最具体的通配符 > 内置表
+func LookupCapability(model string) (config.ModelCapability, bool) {
+	caps := config.Get().Capabilities
+	if c, ok := caps[model]; ok {
+		return c, true
+	}
+	if pattern, ok := mostSpecificPattern(slices.Collect(maps.Keys(caps)), model); ok {
+		return caps[pattern], true
+	}
+	for _, b := range builtinCapabilities {
+		if _, ok := matchModel(config.ModelRoute{From: b.pattern}, model); ok {
+			return b.cap, true
+		}
+	}
+	return config.ModelCapability{}, false
+}
+
+func supports(b *bool) bool {
+	return b == nil || *b
+}
+
+// NormalizeAnthropicRaw 按模型能力规范化透传的 Anthropic 请求：max_tokens 缺省时补默认值并限制在模型上限内，
+// 去掉模型不支持的 thinking 并让 budget_tokens 小于 max_tokens，temperature 和 top_p 互斥时去掉 top_p
+func NormalizeAnthropicRaw(raw map[string]json.RawMessage, model string) {
+	c, _ := LookupCapability(model)
+	var maxTokens int
+	json.Unmarshal(raw["max_tokens"], &maxTokens)
+	if maxTokens <= 0 {
+		maxTokens = adapter.DefaultMaxTokens
+	}
+	if c.MaxOutputTokens > 0 && maxTokens > c.MaxOutputTokens {
+		maxTokens = c.MaxOutputTokens
+	}
+	if !supports(c.Thinking) {
+		delete(raw, "thinking")
+	}
+	var t adapter.Thinking
+	if json.Unmarshal(raw["thinking"], &t) == nil && t.Type == "enabled" {
+		// 与 adapter 的转换一致：max_tokens 必须大于 budget_tokens，模型输出上限不够时压缩 budget
+		if maxTokens <= t.BudgetTokens {
+			maxTokens = t.BudgetTokens + adapter.DefaultMaxTokens
+			if c.MaxOutputTokens > 0 && maxTokens > c.MaxOutputTokens {
+				maxTokens = c.MaxOutputTokens
+			}
+		}
+		if maxTokens <= t.BudgetTokens {
+			t.BudgetTokens = max(maxTokens/2, 1024)
+			raw["thinking"], _ = json.Marshal(t)
+		}
+	}
+	raw["max_tokens"], _ = json.Marshal(maxTokens)
+	if c.ExclusiveSampling && raw["temperature"] != nil && raw["top_p"] != nil {
+		delete(raw, "top_p")
+	}
+}
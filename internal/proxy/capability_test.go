@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNormalizeAnthropicRawThinking(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		model      string
+		wantMax    int
+		wantBudget int // 0 表示没有 thinking
+	}{
+		{"budget fits", `{"max_tokens":20000,"thinking":{"type":"enabled","budget_tokens":10000}}`, "claude-opus-4-1", 20000, 10000},
+		{"max_tokens raised", `{"max_tokens":4000,"thinking":{"type":"enabled","budget_tokens":10000}}`, "claude-opus-4-1", 18192, 10000},
+		{"budget shrunk to clamp", `{"max_tokens":50000,"thinking":{"type":"enabled","budget_tokens":40000}}`, "claude-opus-4-1", 32000, 16000},
+		{"thinking unsupported", `{"max_tokens":4000,"thinking":{"type":"enabled","budget_tokens":10000}}`, "claude-3-opus", 4000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(tt.body), &raw); err != nil {
+				t.Fatal(err)
+			}
+			NormalizeAnthropicRaw(raw, tt.model)
+			var maxTokens int
+			json.Unmarshal(raw["max_tokens"], &maxTokens)
+			var thinking struct {
+				BudgetTokens int `json:"budget_tokens"`
+			}
+			json.Unmarshal(raw["thinking"], &thinking)
+			if maxTokens != tt.wantMax || thinking.BudgetTokens != tt.wantBudget {
+				t.Fatalf("max_tokens = %d, budget = %d, want %d, %d", maxTokens, thinking.BudgetTokens, tt.wantMax, tt.wantBudget)
+			}
+		})
+	}
+}
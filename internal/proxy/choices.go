@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"cursor-api-2-claude/internal/adapter"
+	"cursor-api-2-claude/internal/config"
+)
+
+// maxChoices 是 Anthropic 上游 n 的上限，每个候选都要单独发一次请求；OpenAI 上游原样转发，不受限制
+const maxChoices = 8
+
+// proxyAnthropicN 处理 n > 1：Anthropic 没有对应参数，并发发出 n 个相同的请求，
+// 合并为带序号的 choices，用量求和。所有请求都拿到响应头之后才开始写出。
+// 每个请求在 sendUpstream 里各自退避重试，只重发失败的那一个；重试用完仍失败时
+// 丢弃已成功的响应，整组换 provider 重试。
+func proxyAnthropicN(w http.ResponseWriter, r *http.Request, req adapter.OAIRequest, p config.Provider, model, url string, body []byte, n int, timeout time.Duration) error {
+	if n > maxChoices {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("n must be at most %d for provider %s", maxChoices, p.ID)})
+		return nil
+	}
+	resps := make([]*http.Response, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resps[i], errs[i] = sendUpstream(r, p, url, body, anthropicHeader(p), timeout)
+		}()
+	}
+	wg.Wait()
+	defer func() {
+		for _, resp := range resps {
+			if resp != nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	for i := range n {
+		if errs[i] != nil {
+			return errs[i]
+		}
+	}
+	for _, resp := range resps {
+		if resp.StatusCode != 200 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(resp.StatusCode)
+			respBody, _ := io.ReadAll(resp.Body)
+			log.Printf("[DEBUG] ===== Anthropic Error Response =====\n%s", string(respBody))
+			w.Write(respBody)
+			return nil
+		}
+	}
+
+	if req.Stream {
+		usage, err := streamAnthropicN(w, resps, req)
+		recordUsage(r, p, model, &usage)
+		return streamFailure(r, p, err)
+	}
+
+	var merged adapter.OAIResponse
+	var usage adapter.AnthropicUsage
+	for i, resp := range resps {
+		respBody, _ := io.ReadAll(resp.Body)
+		var ar adapter.AnthropicResponse
+		if err := json.Unmarshal(respBody, &ar); err != nil {
+			http.Error(w, `{"error":"decode error"}`, http.StatusBadGateway)
+			return nil
+		}
+		recordUsage(r, p, model, ar.Usage)
+		oai := adapter.AnthropicToOpenai(ar, req.Model)
+		choice := oai.Choices[0]
+		if *choice.FinishReason == "stop" {
+			if err := validateResponseFormat(req, choice.Message.Content); err != nil {
+				log.Printf("[response_format] provider %s choice %d: %v", p.ID, i, err)
+				writeResponseFormatError(w, err)
+				return nil
+			}
+		}
+		choice.Index = i
+		if i == 0 {
+			merged = oai
+			merged.Choices = nil
+		}
+		merged.Choices = append(merged.Choices, choice)
+		adapter.AddUsage(&usage, ar.Usage)
+	}
+	merged.Usage = adapter.ToOAIUsage(&usage)
+
+	oaiBody, _ := json.Marshal(merged)
+	log.Printf("[DEBUG] ===== OAI Response (n=%d) =====\n%s", n, indentJSON(oaiBody))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(oaiBody)
+	return nil
+}
+
+// streamAnthropicN 同时读取 n 个上游流，按到达顺序交错写出，每个 chunk 的 choice index 标为对应的序号；
+// 返回所有流的用量之和以及中途出错的流的错误
+func streamAnthropicN(w http.ResponseWriter, resps []*http.Response, req adapter.OAIRequest) (adapter.AnthropicUsage, error) {
+	model := req.Model
+	var usage adapter.AnthropicUsage
+	flusher, ok := startSSE(w)
+	if !ok {
+		return usage, nil
+	}
+
+	chunks := make(chan adapter.OAIResponse)
+	states := make([]*adapter.StreamState, len(resps))
+	errs := make([]error, len(resps))
+	var wg sync.WaitGroup
+	for i, resp := range resps {
+		states[i] = &adapter.StreamState{Structured: adapter.HasStructuredOutput(req.ResponseFormat)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = scanAnthropicSSE(resp.Body, func(event string, data json.RawMessage) {
+				for _, chunk := range adapter.AnthropicStreamEventToChunks(event, data, states[i], model) {
+					// 用量最后合并发送
+					chunk.Usage = nil
+					for j := range chunk.Choices {
+						chunk.Choices[j].Index = i
+					}
+					chunks <- chunk
+				}
+			})
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(chunks)
+	}()
+
+	for chunk := range chunks {
+		writeChunk(w, flusher, chunk)
+	}
+
+	for _, st := range states {
+		adapter.AddUsage(&usage, &st.Usage)
+	}
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		writeChunk(w, flusher, adapter.OAIResponse{
+			ID:      "chatcmpl-stream",
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   model,
+			Choices: []adapter.OAIChoice{},
+			Usage:   adapter.ToOAIUsage(&usage),
+		})
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+	return usage, errors.Join(errs...)
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+
+	"cursor-api-2-claude/internal/adapter"
+	"cursor-api-2-claude/internal/config"
+)
+
+// Usage 是一次请求的 token 用量，Input 不包含缓存读写部分
+type Usage struct {
+	Input      int `json:"input_tokens"`
+	Output     int `json:"output_tokens"`
+	CacheRead  int `json:"cache_read_tokens"`
+	CacheWrite int `json:"cache_write_tokens"`
+}
+
+// lookupPrice 按目标模型查 provider 的价格表，先精确匹配再按最具体的通配符
+func lookupPrice(p config.Provider, model string) (config.ModelPrice, bool) {
+	if price, ok := p.Prices[model]; ok {
+		return price, true
+	}
+	if pattern, ok := mostSpecificPattern(slices.Collect(maps.Keys(p.Prices)), model); ok {
+		return p.Prices[pattern], true
+	}
+	return config.ModelPrice{}, false
+}
+
+// Cost 按价格表计算一次请求的费用
+func Cost(price config.ModelPrice, u Usage) float64 {
+	cacheRead, cacheWrite := price.CacheRead, price.CacheWrite
+	if cacheRead == 0 {
+		cacheRead = price.Input
+	}
+	if cacheWrite == 0 {
+		cacheWrite = price.Input
+	}
+	return (float64(u.Input)*price.Input +
+		float64(u.Output)*price.Output +
+		float64(u.CacheRead)*cacheRead +
+		float64(u.CacheWrite)*cacheWrite) / 1e6
+}
+
+// cheapestIndex 选出价格最低的 provider（按每百万输入 + 输出价格比较），
+// 配置了延迟上限时先排除已知延迟超限的，全部超限时不做限制；没有价格的排在最后
+func cheapestIndex(routes []Route) int {
+	statsMu.Lock()
+	latency := make([]float64, len(routes))
+	known := make([]bool, len(routes))
+	for i, rt := range routes {
+		st := getStatsLocked(rt.Provider.ID)
+		latency[i], known[i] = st.latencyMs, st.latencyN > 0
+	}
+	statsMu.Unlock()
+
+	// 偶尔忽略延迟上限，让超限过的 provider 重新拿到样本，延迟恢复后能回到比价
+	explore := exploreLatency()
+	var fast []int
+	for i, rt := range routes {
+		if explore || rt.MaxLatencyMs <= 0 || !known[i] || latency[i] <= float64(rt.MaxLatencyMs) {
+			fast = append(fast, i)
+		}
+	}
+	if len(fast) == 0 {
+		for i := range routes {
+			fast = append(fast, i)
+		}
+	}
+
+	pool := make([]Route, len(fast))
+	for i, idx := range fast {
+		pool[i] = routes[idx]
+	}
+	best := weightedAmongBest(pool, func(rt Route) float64 {
+		price, ok := lookupPrice(rt.Provider, rt.Model)
+		if !ok {
+			return math.Inf(1)
+		}
+		return price.Input + price.Output
+	})
+	return fast[best]
+}
+
+// recordUsage 按目标模型的价格记账，u 来自各 adapter 解析出的响应用量；影子请求不计入
+func recordUsage(r *http.Request, p config.Provider, model string, u *adapter.AnthropicUsage) {
+	if u == nil || *u == (adapter.AnthropicUsage{}) || isShadow(r) {
+		return
+	}
+	usage := Usage{
+		Input:      u.InputTokens,
+		Output:     u.OutputTokens,
+		CacheRead:  u.CacheReadInputTokens,
+		CacheWrite: u.CacheCreationInputTokens,
+	}
+	cost := 0.0
+	price, priced := lookupPrice(p, model)
+	if priced {
+		cost = Cost(price, usage)
+	}
+	statsMu.Lock()
+	st := getStatsLocked(p.ID)
+	st.usage.Input += usage.Input
+	st.usage.Output += usage.Output
+	st.usage.CacheRead += usage.CacheRead
+	st.usage.CacheWrite += usage.CacheWrite
+	st.cost += cost
+	statsMu.Unlock()
+	if priced {
+		log.Printf("[cost] provider %s model %s: in=%d out=%d cache_read=%d cache_write=%d cost=$%.6f",
+			p.ID, model, usage.Input, usage.Output, usage.CacheRead, usage.CacheWrite, cost)
+	}
+}
+
+// bodyModel 取请求体里的 model 字段
+func bodyModel(body []byte) string {
+	var probe struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(body, &probe)
+	return probe.Model
+}
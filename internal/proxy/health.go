@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cursor-api-2-claude/internal/config"
+)
+
+const (
+	healthHistorySize    = 20
+	healthFailThreshold  = 2 // 连续探测失败多少次判定为不健康
+	healthProbeTimeout   = 15 * time.Second
+	healthSchedulerDelay = time.Second
+)
+
+type ProbeResult struct {
+	Time      time.Time `json:"time"`
+	OK        bool      `json:"ok"`
+	Status    int       `json:"status,omitempty"`
+	LatencyMs int64     `json:"latency_ms"`
+	Reply     string    `json:"reply,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Probe 向 provider 的指定模型发送一个 max_tokens=1 的最小请求
+func Probe(p config.Provider, model string, timeout time.Duration) ProbeResult {
+	client := &http.Client{Timeout: timeout}
+	start := time.Now()
+	res := ProbeResult{Time: start}
+
+	body, _ := json.Marshal(map[string]any{
+		"model":      model,
+		"max_tokens": 1,
+		"messages":   []map[string]string{{"role": "user", "content": "Hi"}},
+	})
+	base := strings.TrimRight(p.BaseURL, "/")
+	var httpReq *http.Request
+	switch p.Type {
+	case "anthropic":
+		httpReq, _ = http.NewRequest("POST", base+"/v1/messages", bytes.NewReader(body))
+		httpReq.Header = anthropicHeader(p)
+	default:
+		httpReq, _ = http.NewRequest("POST", base+"/v1/chat/completions", bytes.NewReader(body))
+		httpReq.Header = openaiHeader(p)
+	}
+
+	resp, err := client.Do(httpReq)
+	res.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+
+	res.Status = resp.StatusCode
+	res.OK = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !res.OK {
+		res.Error = string(respBody)
+		return res
+	}
+
+	if p.Type == "anthropic" {
+		var ar struct {
+			Content []struct {
+				Text string `json:"text"`
+			} `json:"content"`
+		}
+		if json.Unmarshal(respBody, &ar) == nil && len(ar.Content) > 0 {
+			res.Reply = ar.Content[0].Text
+		}
+	} else {
+		var or struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+		}
+		if json.Unmarshal(respBody, &or) == nil && len(or.Choices) > 0 {
+			res.Reply = or.Choices[0].Message.Content
+		}
+	}
+	return res
+}
+
+// targetHealth 记录某个 provider 上某个目标模型的探测历史
+type targetHealth struct {
+	history  []ProbeResult
+	failures int
+	running  bool
+	lastRun  time.Time
+}
+
+var (
+	healthStates = map[string]map[string]*targetHealth{} // provider ID -> model -> 状态
+	healthMu     sync.Mutex
+)
+
+// StartHealthChecker 启动后台健康检查，按各 provider 自己的间隔探测
+func StartHealthChecker() {
+	go func() {
+		for {
+			runDueProbes()
+			time.Sleep(healthSchedulerDelay)
+		}
+	}()
+}
+
+// probeModels 返回需要探测的目标模型；含通配符或正则引用的路由无法确定模型名，跳过
+func probeModels(p config.Provider) []string {
+	if p.HealthCheckModel != "" {
+		return []string{p.HealthCheckModel}
+	}
+	seen := map[string]bool{}
+	var models []string
+	for _, m := range p.Models {
+		if !m.Enabled || seen[m.To] || strings.ContainsAny(m.To, "*$") {
+			continue
+		}
+		seen[m.To] = true
+		models = append(models, m.To)
+	}
+	return models
+}
+
+func runDueProbes() {
+	c := config.Get()
+	now := time.Now()
+	pruneHealthStates(c)
+	for _, p := range c.Providers {
+		if p.HealthCheckInterval <= 0 || p.Weight <= 0 {
+			continue
+		}
+		interval := time.Duration(p.HealthCheckInterval) * time.Second
+		for _, model := range probeModels(p) {
+			healthMu.Lock()
+			th := getTargetHealthLocked(p.ID, model)
+			due := !th.running && now.Sub(th.lastRun) >= interval
+			if due {
+				th.running = true
+				th.lastRun = now
+			}
+			healthMu.Unlock()
+			if due {
+				go runProbe(p, model)
+			}
+		}
+	}
+}
+
+// pruneHealthStates 丢掉不再探测的状态：provider 被删除、停用或关闭了健康检查，
+// 或者目标模型已经不在 probeModels 里（改了 health_check_model 或删了路由）。
+// 否则这些目标会一直保持不健康，又没有探测能把它恢复
+func pruneHealthStates(c config.Config) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	active := map[string]map[string]bool{}
+	for _, p := range c.Providers {
+		if p.HealthCheckInterval <= 0 || p.Weight <= 0 {
+			continue
+		}
+		models := map[string]bool{}
+		for _, m := range probeModels(p) {
+			models[m] = true
+		}
+		active[p.ID] = models
+	}
+	for id, targets := range healthStates {
+		models, ok := active[id]
+		if !ok {
+			delete(healthStates, id)
+			continue
+		}
+		for model, th := range targets {
+			if !models[model] && !th.running {
+				delete(targets, model)
+			}
+		}
+	}
+}
+
+func getTargetHealthLocked(providerID, model string) *targetHealth {
+	models, ok := healthStates[providerID]
+	if !ok {
+		models = map[string]*targetHealth{}
+		healthStates[providerID] = models
+	}
+	th, ok := models[model]
+	if !ok {
+		th = &targetHealth{}
+		models[model] = th
+	}
+	return th
+}
+
+func runProbe(p config.Provider, model string) {
+	res := Probe(p, model, healthProbeTimeout)
+	res.Reply = ""
+
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	th := getTargetHealthLocked(p.ID, model)
+	th.running = false
+	th.history = append(th.history, res)
+	if len(th.history) > healthHistorySize {
+		th.history = th.history[len(th.history)-healthHistorySize:]
+	}
+	wasHealthy := th.failures < healthFailThreshold
+	if res.OK {
+		th.failures = 0
+	} else {
+		th.failures++
+	}
+	healthy := th.failures < healthFailThreshold
+	if wasHealthy != healthy {
+		log.Printf("[health] provider %s model %s healthy=%v (status %d, %dms)", p.ID, model, healthy, res.Status, res.LatencyMs)
+	}
+}
+
+func targetHealthyLocked(providerID, model string) bool {
+	th, ok := healthStates[providerID][model]
+	return !ok || th.failures < healthFailThreshold
+}
+
+// healthAvailable 根据主动探测结果判断路由是否可用；没有开启健康检查或没有探测数据时视为可用
+func healthAvailable(rt Route) bool {
+	if rt.Provider.HealthCheckInterval <= 0 {
+		return true
+	}
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	if !targetHealthyLocked(rt.Provider.ID, rt.Model) {
+		return false
+	}
+	if m := rt.Provider.HealthCheckModel; m != "" && !targetHealthyLocked(rt.Provider.ID, m) {
+		return false
+	}
+	return true
+}
+
+type TargetHealthStatus struct {
+	Model     string        `json:"model"`
+	Healthy   bool          `json:"healthy"`
+	Failures  int           `json:"consecutive_failures"`
+	LatencyMs int64         `json:"latency_ms"`
+	History   []ProbeResult `json:"history"`
+}
+
+type ProviderHealthStatus struct {
+	Provider  string               `json:"provider"`
+	Checked   bool                 `json:"checked"`
+	Available bool                 `json:"available"`
+	Breaker   string               `json:"breaker"`
+	Targets   []TargetHealthStatus `json:"targets"`
+}
+
+// Health 汇总所有 provider 的主动探测结果和熔断状态
+func Health() []ProviderHealthStatus {
+	c := config.Get()
+	breakerStates := map[string]string{}
+	for _, b := range Breakers() {
+		breakerStates[b.Provider] = b.State
+	}
+
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	list := []ProviderHealthStatus{}
+	for _, p := range c.Providers {
+		st := ProviderHealthStatus{
+			Provider:  p.ID,
+			Checked:   p.HealthCheckInterval > 0,
+			Available: p.Weight > 0 && breakerStates[p.ID] != breakerOpen,
+			Breaker:   breakerStates[p.ID],
+			Targets:   []TargetHealthStatus{},
+		}
+		if !st.Checked {
+			list = append(list, st)
+			continue
+		}
+		anyHealthy := false
+		for _, model := range probeModels(p) {
+			th, ok := healthStates[p.ID][model]
+			if !ok {
+				anyHealthy = true
+				continue
+			}
+			ts := TargetHealthStatus{
+				Model:    model,
+				Healthy:  th.failures < healthFailThreshold,
+				Failures: th.failures,
+				History:  append([]ProbeResult(nil), th.history...),
+			}
+			if n := len(th.history); n > 0 {
+				ts.LatencyMs = th.history[n-1].LatencyMs
+			}
+			anyHealthy = anyHealthy || ts.Healthy
+			st.Targets = append(st.Targets, ts)
+		}
+		if len(st.Targets) > 0 && !anyHealthy {
+			st.Available = false
+		}
+		list = append(list, st)
+	}
+	return list
+}
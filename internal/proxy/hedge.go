@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"cursor-api-2-claude/internal/config"
+)
+
+const hedgeMinSamples = 20
+
+// HedgingEnabled 判断本次请求是否走对冲：只用于非流式请求，且至少有两个候选
+func HedgingEnabled(routes []Route, stream bool) bool {
+	return config.Get().Hedging.Enabled && !stream && len(routes) > 1
+}
+
+func hedgeDelay(providerID string) time.Duration {
+	hc := config.Get().Hedging
+	q := hc.Percentile
+	if q <= 0 || q >= 1 {
+		q = 0.95
+	}
+	minDelay := time.Duration(hc.MinDelayMs) * time.Millisecond
+	if minDelay == 0 {
+		minDelay = 2 * time.Second
+	}
+	if d, ok := latencyPercentile(providerID, q, hedgeMinSamples); ok && d > minDelay {
+		return d
+	}
+	return minDelay
+}
+
+// bufferWriter 缓存一次尝试的完整响应，对冲结束后只把胜出的那份写给客户端
+type bufferWriter struct {
+	header http.Header
+	status int
+	buf    bytes.Buffer
+}
+
+func newBufferWriter() *bufferWriter {
+	return &bufferWriter{header: http.Header{}}
+}
+
+func (b *bufferWriter) Header() http.Header { return b.header }
+
+func (b *bufferWriter) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *bufferWriter) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.buf.Write(p)
+}
+
+func (b *bufferWriter) Flush() {}
+
+func (b *bufferWriter) Status() int { return b.status }
+
+func (b *bufferWriter) copyTo(w http.ResponseWriter) {
+	for k, vs := range b.header {
+		w.Header()[k] = vs
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.buf.Bytes())
+}
+
+// responseHookKey 在请求上下文里挂一个回调，sendUpstream 拿到不可重试的响应头时调用
+type responseHookKey struct{}
+
+func withResponseHook(ctx context.Context, fn func()) context.Context {
+	return context.WithValue(ctx, responseHookKey{}, fn)
+}
+
+func notifyResponse(r *http.Request) {
+	if fn, ok := r.Context().Value(responseHookKey{}).(func()); ok {
+		fn()
+	}
+}
+
+type hedgeLeg struct {
+	rt     Route
+	out    *bufferWriter
+	cancel context.CancelFunc
+	err    error
+}
+
+// Hedge 先向按策略选出的 provider 发请求；如果它在分位数延迟内还没返回响应头，
+// 再向下一个候选发同样的请求，先完成的那个写回客户端，另一个被取消。
+// 两路都以可重试错误失败时，继续按 Failover 的方式尝试剩下的 provider。
+func Hedge(w http.ResponseWriter, r *http.Request, routes []Route, affinityKey string, attempt func(w http.ResponseWriter, r *http.Request, rt Route) error) error {
+	pk := newPicker(routes, affinityKey)
+	done := make(chan *hedgeLeg, 2)
+	headers := make(chan struct{}, 2)
+
+	start := func(rt Route) *hedgeLeg {
+		ctx, cancel := context.WithCancel(r.Context())
+		var once sync.Once
+		// 429/529 等可重试响应不算拿到响应头，否则会错过对冲
+		ctx = withResponseHook(ctx, func() { once.Do(func() { headers <- struct{}{} }) })
+		leg := &hedgeLeg{rt: rt, out: newBufferWriter(), cancel: cancel}
+		go func() {
+			leg.err = runAttempt(ctx, rt, leg.out, func(rt Route) error {
+				return attempt(leg.out, r.WithContext(ctx), rt)
+			})
+			done <- leg
+		}()
+		return leg
+	}
+
+	primary, ok := pk.next()
+	if !ok {
+		return errNoProvider
+	}
+	legs := []*hedgeLeg{start(primary)}
+	timer := time.NewTimer(hedgeDelay(primary.Provider.ID))
+	defer timer.Stop()
+
+	running := 1
+	hedged, gotHeaders := false, false
+	var lastErr error
+	for running > 0 {
+		select {
+		case <-headers:
+			// 已经有一路拿到响应头，不再需要对冲
+			gotHeaders = true
+			timer.Stop()
+		case <-timer.C:
+			if !hedged && !gotHeaders {
+				if rt, ok := pk.next(); ok {
+					hedged = true
+					log.Printf("[hedge] provider %s slow, hedging with %s", primary.Provider.ID, rt.Provider.ID)
+					legs = append(legs, start(rt))
+					running++
+				}
+			}
+		case leg := <-done:
+			running--
+			if isUpstreamError(leg.err) {
+				lastErr = leg.err
+				log.Printf("[hedge] %v", leg.err)
+				// 主请求在对冲之前就失败了，直接用下一个候选补上
+				if !hedged {
+					if rt, ok := pk.next(); ok {
+						hedged = true
+						legs = append(legs, start(rt))
+						running++
+					}
+				}
+				continue
+			}
+			for _, other := range legs {
+				if other != leg {
+					other.cancel()
+				}
+			}
+			if leg.err == nil {
+				leg.out.copyTo(w)
+			}
+			leg.cancel()
+			return leg.err
+		}
+	}
+
+	return failoverWith(pk, w, r, lastErr, attempt)
+}
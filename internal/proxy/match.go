@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"cursor-api-2-claude/internal/config"
+)
+
+// 编译后的模式缓存。模式都来自配置，数量有限；配置反复修改时旧模式会残留，超过上限后整体清空
+const maxPatternCache = 1024
+
+var (
+	patternCache   = map[string]*regexp.Regexp{}
+	patternCacheMu sync.RWMutex
+)
+
+// matchModel 判断请求模型是否命中路由，命中时返回替换后的目标模型名
+func matchModel(m config.ModelRoute, model string) (string, bool) {
+	re, err := compileRoute(m)
+	if err != nil {
+		return "", false
+	}
+	idx := re.FindStringSubmatchIndex(model)
+	if idx == nil {
+		return "", false
+	}
+	if m.Regex {
+		return string(re.ExpandString(nil, m.To, model, idx)), true
+	}
+
+	// 通配符：To 里的每个 * 依次替换为 From 中对应 * 捕获的内容
+	var b strings.Builder
+	group := 1
+	for _, ch := range m.To {
+		if ch == '*' && group*2+1 < len(idx) {
+			b.WriteString(model[idx[group*2]:idx[group*2+1]])
+			group++
+			continue
+		}
+		b.WriteRune(ch)
+	}
+	return b.String(), true
+}
+
+func compileRoute(m config.ModelRoute) (*regexp.Regexp, error) {
+	key := m.From
+	if m.Regex {
+		key = "re:" + m.From
+	}
+	patternCacheMu.RLock()
+	re, ok := patternCache[key]
+	patternCacheMu.RUnlock()
+	if ok {
+		return re, nil
+	}
+
+	var expr string
+	if m.Regex {
+		expr = "^(?:" + m.From + ")$"
+	} else {
+		expr = globToRegexp(m.From)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	patternCacheMu.Lock()
+	if len(patternCache) >= maxPatternCache {
+		patternCache = map[string]*regexp.Regexp{}
+	}
+	patternCache[key] = re
+	patternCacheMu.Unlock()
+	return re, nil
+}
+
+// globToRegexp 把通配符模式转换为正则，语法与 path.Match 一致：只有 * 是捕获分组（供 To 中的 * 依次引用），
+// ? 匹配单个字符，[...] 为字符类（[^...] / [!...] 取反），\ 转义下一个字符
+func globToRegexp(pattern string) string {
+	rs := []rune(pattern)
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(rs); i++ {
+		switch ch := rs[i]; ch {
+		case '*':
+			b.WriteString("(.*)")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(rs) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(string(rs[i])))
+		case '[':
+			class, n := globClass(rs[i+1:])
+			if n == 0 {
+				// 没有闭合的 ]，按字面匹配
+				b.WriteString(`\[`)
+				continue
+			}
+			b.WriteString(class)
+			i += n
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// globClass 转换 [ 之后的字符类，返回正则字符类和消耗的字符数（含结尾的 ]），没有闭合时返回 0
+func globClass(rs []rune) (string, int) {
+	var b strings.Builder
+	b.WriteString("[")
+	i := 0
+	if i < len(rs) && (rs[i] == '^' || rs[i] == '!') {
+		b.WriteString("^")
+		i++
+	}
+	start := i
+	for ; i < len(rs); i++ {
+		ch := rs[i]
+		switch {
+		case ch == ']' && i > start:
+			b.WriteString("]")
+			return b.String(), i + 1
+		case ch == '\\' && i+1 < len(rs):
+			i++
+			b.WriteString(classChar(rs[i]))
+		case ch == '-':
+			b.WriteRune(ch)
+		default:
+			b.WriteString(classChar(ch))
+		}
+	}
+	return "", 0
+}
+
+// classChar 字符类里的字面字符，正则特殊符号需要转义，字母数字不能转义（\d 等有特殊含义）
+func classChar(ch rune) string {
+	if strings.ContainsRune(`\[]^-`, ch) {
+		return `\` + string(ch)
+	}
+	return string(ch)
+}
+
+// mostSpecificPattern 返回匹配 model 的通配符里最具体的一个：非通配字符多的优先，
+// 相同时按字典序，保证结果不受 map 遍历顺序影响
+func mostSpecificPattern(patterns []string, model string) (string, bool) {
+	best, bestScore := "", -1
+	for _, pattern := range patterns {
+		if _, ok := matchModel(config.ModelRoute{From: pattern}, model); !ok {
+			continue
+		}
+		score := len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+		if score > bestScore || score == bestScore && pattern < best {
+			best, bestScore = pattern, score
+		}
+	}
+	return best, bestScore >= 0
+}
+
+// ValidateRoutes 检查配置中的正则路由能否编译、策略名和灰度配置是否合法、路由规则引用的 provider 是否存在
+func ValidateRoutes(c config.Config) error {
+	for _, p := range c.Providers {
+		for _, m := range p.Models {
+			switch m.Strategy {
+			case "", StrategyWeighted, StrategyRoundRobin, StrategyLeastOutstanding, StrategyLatency, StrategyPriority, StrategyCheapest:
+			default:
+				return fmt.Errorf("provider %s: unknown strategy %q", p.ID, m.Strategy)
+			}
+			if m.Canary != nil && (m.Canary.To == "" || m.Canary.Percent < 0 || m.Canary.Percent > 100) {
+				return fmt.Errorf("provider %s: canary of %s needs a target model and a percent between 0 and 100", p.ID, m.From)
+			}
+			if m.Shadow != nil && !providerExists(c, m.Shadow.Provider) {
+				return fmt.Errorf("provider %s: unknown shadow provider %s", p.ID, m.Shadow.Provider)
+			}
+			if !m.Regex {
+				continue
+			}
+			if _, err := compileRoute(m); err != nil {
+				return fmt.Errorf("provider %s: invalid regex %q: %v", p.ID, m.From, err)
+			}
+		}
+	}
+	return validateRules(c)
+}
+
+func providerExists(c config.Config, id string) bool {
+	for _, p := range c.Providers {
+		if p.ID == id {
+			return true
+		}
+	}
+	return false
+}
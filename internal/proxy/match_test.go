@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+
+	"cursor-api-2-claude/internal/config"
+)
+
+func TestMatchModel(t *testing.T) {
+	tests := []struct {
+		name      string
+		route     config.ModelRoute
+		model     string
+		want      string
+		wantMatch bool
+	}{
+		{"exact", config.ModelRoute{From: "gpt-4o", To: "claude-sonnet-4-5"}, "gpt-4o", "claude-sonnet-4-5", true},
+		{"exact miss", config.ModelRoute{From: "gpt-4o", To: "x"}, "gpt-4o-mini", "", false},
+		{"star passthrough", config.ModelRoute{From: "claude-*", To: "claude-*"}, "claude-opus-4-1", "claude-opus-4-1", true},
+		{"star rewrite", config.ModelRoute{From: "gpt-4o-*", To: "claude-sonnet-4-5-*"}, "gpt-4o-2024", "claude-sonnet-4-5-2024", true},
+		{"two stars", config.ModelRoute{From: "*-to-*", To: "*/*"}, "a-to-b", "a/b", true},
+		{"star without target star", config.ModelRoute{From: "gpt-*", To: "fixed"}, "gpt-4", "fixed", true},
+		{"question mark does not capture", config.ModelRoute{From: "gpt-?-*", To: "x-*"}, "gpt-4-turbo", "x-turbo", true},
+		{"question mark single char", config.ModelRoute{From: "gpt-?", To: "x"}, "gpt-45", "", false},
+		{"class", config.ModelRoute{From: "claude-[3]*", To: "c*"}, "claude-3-opus", "c-opus", true},
+		{"class miss", config.ModelRoute{From: "claude-[3]*", To: "c*"}, "claude-4-opus", "", false},
+		{"class range", config.ModelRoute{From: "v[0-9]", To: "x"}, "v7", "x", true},
+		{"negated class", config.ModelRoute{From: "v[!0-9]", To: "x"}, "v7", "", false},
+		{"negated class caret", config.ModelRoute{From: "v[^0-9]", To: "x"}, "va", "x", true},
+		{"class escaped letter is literal", config.ModelRoute{From: `v[\d]`, To: "x"}, "vd", "x", true},
+		{"unclosed bracket literal", config.ModelRoute{From: "a[b", To: "x"}, "a[b", "x", true},
+		{"escaped star literal", config.ModelRoute{From: `a\*`, To: "x"}, "a*", "x", true},
+		{"escaped star no wildcard", config.ModelRoute{From: `a\*`, To: "x"}, "ab", "", false},
+		{"dot is literal", config.ModelRoute{From: "gpt-4.1", To: "x"}, "gpt-401", "", false},
+		{"regex groups", config.ModelRoute{From: `sonnet-(\d+)-(\d+)`, To: "claude-sonnet-$1-$2", Regex: true}, "sonnet-4-5", "claude-sonnet-4-5", true},
+		{"regex anchored", config.ModelRoute{From: `sonnet-\d`, To: "x", Regex: true}, "my-sonnet-4", "", false},
+		{"invalid regex", config.ModelRoute{From: `(`, To: "x", Regex: true}, "(", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := matchModel(tt.route, tt.model)
+			if ok != tt.wantMatch || got != tt.want {
+				t.Errorf("matchModel(%q -> %q, %q) = %q, %v; want %q, %v", tt.route.From, tt.route.To, tt.model, got, ok, tt.want, tt.wantMatch)
+			}
+		})
+	}
+}
+
+func TestPatternCacheBounded(t *testing.T) {
+	for i := 0; i < maxPatternCache*2; i++ {
+		matchModel(config.ModelRoute{From: fmt.Sprintf("m-%d-*", i)}, "x")
+	}
+	patternCacheMu.RLock()
+	n := len(patternCache)
+	patternCacheMu.RUnlock()
+	if n > maxPatternCache {
+		t.Errorf("pattern cache has %d entries, want <= %d", n, maxPatternCache)
+	}
+}
@@ -3,13 +3,15 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand/v2"
 	"net/http"
-	"path"
+	"slices"
 	"strings"
 	"time"
 
@@ -17,76 +19,536 @@ import (
 	"cursor-api-2-claude/internal/config"
 )
 
-func ResolveModel(model string, c config.Config) (string, []config.Provider) {
-	type match struct {
-		provider config.Provider
-		to       string
-	}
-	var matches []match
+// Route 是一次模型匹配的结果：provider 以及该 provider 自己映射出的目标模型名
+type Route struct {
+	Provider config.Provider
+	Model    string
+	From     string // 命中的路由 From，用于统计
+	Variant  string // 灰度中为 stable / canary，否则为空
+	Strategy string
+	Priority int
+	// MaxLatencyMs 为 cheapest 策略的延迟上限
+	MaxLatencyMs int
+	Shadow       *config.ShadowConfig
+}
+
+func ResolveModel(model string, c config.Config) []Route {
+	var routes []Route
 	for _, p := range c.Providers {
 		if p.Weight <= 0 {
 			continue
 		}
 		for _, m := range p.Models {
-			if m.Enabled && matchModel(m.From, model) {
-				matches = append(matches, match{provider: p, to: m.To})
+			if !m.Enabled {
+				continue
+			}
+			if to, ok := matchModel(m, model); ok {
+				rt := Route{Provider: p, Model: to, From: m.From, Strategy: m.Strategy, Priority: m.Priority, MaxLatencyMs: m.MaxLatencyMs, Shadow: m.Shadow}
+				applyCanary(&rt, m, model)
+				routes = append(routes, rt)
 				break
 			}
 		}
 	}
-	if len(matches) == 0 {
-		return "", nil
-	}
-	targetModel := matches[0].to
-	var providers []config.Provider
-	for _, m := range matches {
-		providers = append(providers, m.provider)
-	}
-	return targetModel, providers
+	return routes
 }
 
-func matchModel(pattern, model string) bool {
-	if pattern == "*" {
-		return true
-	}
-	matched, _ := path.Match(pattern, model)
-	return matched
+func WeightedSelect(routes []Route) Route {
+	return routes[weightedIndex(routes)]
 }
 
-func WeightedSelect(providers []config.Provider) config.Provider {
+func weightedIndex(routes []Route) int {
 	total := 0
-	for _, p := range providers {
-		total += p.Weight
+	for _, rt := range routes {
+		total += rt.Provider.Weight
+	}
+	if total <= 0 {
+		return 0
 	}
 	r := rand.IntN(total)
-	for _, p := range providers {
-		r -= p.Weight
+	for i, rt := range routes {
+		r -= rt.Provider.Weight
 		if r < 0 {
-			return p
+			return i
 		}
 	}
-	return providers[0]
+	return 0
 }
 
-func ProxyAnthropic(w http.ResponseWriter, r *http.Request, req adapter.OAIRequest, p config.Provider, model string, timeout time.Duration) {
-	ar := adapter.OpenaiToAnthropic(req, model)
-	arBody, _ := json.Marshal(ar)
+// UpstreamError 表示上游在向客户端写出任何数据之前就失败了（连接错误、5xx、429、529），
+// 此时可以安全地换下一个 provider 重试。
+type UpstreamError struct {
+	Provider string
+	Status   int
+	Header   http.Header
+	Body     []byte
+	Err      error
+}
 
-	log.Printf("[DEBUG] ===== Anthropic Request =====\n%s", indentJSON(arBody))
+func (e *UpstreamError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("provider %s: %v", e.Provider, e.Err)
+	}
+	return fmt.Sprintf("provider %s: status %d", e.Provider, e.Status)
+}
+
+// writtenStatus 返回 writer 已经写出的状态码，无法获取时为 0
+func writtenStatus(w http.ResponseWriter) int {
+	if sw, ok := w.(interface{ Status() int }); ok {
+		return sw.Status()
+	}
+	return 0
+}
+
+// isSuccessStatus 判断状态码是否为 2xx，0 表示还没写出，按成功处理
+func isSuccessStatus(code int) bool {
+	return code == 0 || code >= 200 && code < 300
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// Failover 按路由策略依次尝试候选 provider。attempt 返回 *UpstreamError 时说明还没有向客户端写出数据，
+// 换一个尚未尝试过的 provider 继续；其它情况（成功，或响应已经开始写出）直接返回。
+// 熔断中或健康检查失败的 provider 会被跳过，每次尝试的结果都计入熔断统计。
+// affinityKey 非空时第一次尝试按会话粘性选择，之后的故障转移仍按策略。
+func Failover(w http.ResponseWriter, r *http.Request, routes []Route, affinityKey string, attempt func(w http.ResponseWriter, r *http.Request, rt Route) error) error {
+	return failoverWith(newPicker(routes, affinityKey), w, r, nil, attempt)
+}
+
+func failoverWith(pk *picker, w http.ResponseWriter, r *http.Request, lastErr error, attempt func(w http.ResponseWriter, r *http.Request, rt Route) error) error {
+	for {
+		rt, ok := pk.next()
+		if !ok {
+			if lastErr == nil {
+				lastErr = errNoProvider
+			}
+			return lastErr
+		}
+		err := runAttempt(r.Context(), rt, w, func(rt Route) error {
+			return attempt(w, r, rt)
+		})
+		if !isUpstreamError(err) {
+			return err
+		}
+		lastErr = err
+		log.Printf("[failover] %v, %d provider(s) left", err, len(pk.remaining))
+	}
+}
+
+func isUpstreamError(err error) bool {
+	var ue *UpstreamError
+	return errors.As(err, &ue)
+}
+
+// errNoProvider 所有候选都因为熔断探测名额被占用而跳过，一次都没有尝试
+var errNoProvider = &UpstreamError{
+	Status: http.StatusServiceUnavailable,
+	Body:   []byte(`{"error":"no available provider"}`),
+	Err:    errors.New("no available provider"),
+}
+
+// StreamError 表示响应已经开始写出后上游中断（读取出错或收到 error 事件），
+// 不能再换 provider，但要计入熔断失败
+type StreamError struct {
+	Provider string
+	Err      error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("provider %s: stream interrupted: %v", e.Provider, e.Err)
+}
+
+func isStreamError(err error) bool {
+	var se *StreamError
+	return errors.As(err, &se)
+}
+
+// streamFailure 把流式转发时的读取错误包装为 *StreamError；客户端自己断开不算 provider 的错
+func streamFailure(r *http.Request, p config.Provider, err error) error {
+	if err == nil || errors.Is(err, io.EOF) {
+		return nil
+	}
+	if r.Context().Err() != nil {
+		return r.Context().Err()
+	}
+	log.Printf("[stream] provider %s: %v", p.ID, err)
+	return &StreamError{Provider: p.ID, Err: err}
+}
+
+// picker 记录一次请求中还没尝试过的候选路由
+type picker struct {
+	all         int
+	remaining   []Route
+	strategy    string
+	rrKey       string
+	affinityKey string
+}
+
+func newPicker(routes []Route, affinityKey string) *picker {
+	return &picker{
+		all:         len(routes),
+		remaining:   append([]Route(nil), routes...),
+		strategy:    routeStrategy(routes),
+		rrKey:       routesKey(routes),
+		affinityKey: affinityKey,
+	}
+}
+
+func (pk *picker) next() (Route, bool) {
+	for len(pk.remaining) > 0 {
+		candidates, available := filterAvailable(pk.remaining)
+		var rt Route
+		if pk.affinityKey != "" && len(pk.remaining) == pk.all {
+			rt = candidates[affinityIndex(candidates, pk.affinityKey)]
+		} else {
+			rt = candidates[selectIndex(candidates, pk.strategy, pk.rrKey)]
+		}
+		pk.remaining = removeRoute(pk.remaining, rt)
+		// 全部不可用时照常发出，不占用探测名额，避免直接拒绝所有请求
+		if !available || breakerAcquire(rt.Provider.ID) {
+			return rt, true
+		}
+		log.Printf("[breaker] provider %s is not accepting requests, skipping", rt.Provider.ID)
+	}
+	return Route{}, false
+}
+
+// runAttempt 执行一次尝试，并把结果计入熔断和负载统计，w 是这次尝试写出响应的 writer
+// 熔断探测名额已经在 picker.next 里占用；ctx 被取消（客户端断开或对冲中落败）的尝试不计入统计
+func runAttempt(ctx context.Context, rt Route, w http.ResponseWriter, attempt func(rt Route) error) error {
+	beginRequest(rt.Provider.ID)
+	start := time.Now()
+	err := attempt(rt)
+	if ctx.Err() != nil {
+		endRequest(rt.Provider.ID, false)
+		breakerRelease(rt.Provider.ID)
+		return err
+	}
+	failed := isUpstreamError(err) || isStreamError(err)
+	endRequest(rt.Provider.ID, failed)
+	// 上游的 4xx 等非 2xx 响应会原样写回客户端，不触发熔断，但灰度对比里算作失败
+	recordVariant(rt, time.Since(start), failed || !isSuccessStatus(writtenStatus(w)))
+	switch {
+	case failed:
+		breakerRecord(rt.Provider.ID, err)
+	case err == nil:
+		breakerRecord(rt.Provider.ID, nil)
+	default:
+		breakerRelease(rt.Provider.ID)
+	}
+	return err
+}
+
+// filterAvailable 去掉熔断中或主动探测不健康的路由；全部不可用时原样返回并且第二个返回值为 false，
+// 避免直接拒绝所有请求
+func filterAvailable(routes []Route) ([]Route, bool) {
+	var out []Route
+	for _, rt := range routes {
+		if breakerAvailable(rt.Provider.ID) && healthAvailable(rt) {
+			out = append(out, rt)
+		}
+	}
+	if len(out) == 0 {
+		return routes, false
+	}
+	return out, true
+}
+
+func removeRoute(routes []Route, rt Route) []Route {
+	for i := range routes {
+		if routes[i].Provider.ID == rt.Provider.ID {
+			return append(routes[:i], routes[i+1:]...)
+		}
+	}
+	return routes
+}
+
+// WriteError 把 Failover 最终失败的结果写回客户端，上游有响应体时原样透传
+func WriteError(w http.ResponseWriter, err error) {
+	if isStreamError(err) || errors.Is(err, context.Canceled) {
+		// 响应已经写出了一部分只能截断；客户端已经断开也不用再写
+		return
+	}
+	var ue *UpstreamError
+	if errors.As(err, &ue) && ue.Status != 0 {
+		copyRateLimitHeaders(w, ue.Header)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(ue.Status)
+		w.Write(ue.Body)
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadGateway)
+	w.Write(body)
+}
+
+// WriteAnthropicError 同 WriteError，但总是输出 Anthropic 的错误格式，用于 /v1/messages：
+// OpenAI provider 的错误响应体和代理自身的错误都转换过去
+func WriteAnthropicError(w http.ResponseWriter, err error) {
+	if isStreamError(err) || errors.Is(err, context.Canceled) {
+		return
+	}
+	status, body := http.StatusBadGateway, []byte(err.Error())
+	var ue *UpstreamError
+	if errors.As(err, &ue) && ue.Status != 0 {
+		status, body = ue.Status, ue.Body
+		copyRateLimitHeaders(w, ue.Header)
+	}
+	var probe struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(body, &probe) != nil || probe.Type != "error" {
+		body = adapter.OpenAIErrorToAnthropic(body, status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// copyRateLimitHeaders 把最后一个上游的 Retry-After 和限流头带给客户端，方便客户端自己退避
+func copyRateLimitHeaders(w http.ResponseWriter, h http.Header) {
+	for k, vs := range h {
+		lk := strings.ToLower(k)
+		if lk == "retry-after" || strings.HasPrefix(lk, "anthropic-ratelimit-") || strings.HasPrefix(lk, "x-ratelimit-") {
+			w.Header()[k] = vs
+		}
+	}
+}
+
+func Timeout(p config.Provider) time.Duration {
+	timeout := time.Duration(p.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 300 * time.Second
+	}
+	return timeout
+}
 
+// sendUpstream 发送请求，可重试的失败会按配置在同一 provider 上退避重试。
+// 连接错误和可重试状态码会读完响应体并返回 *UpstreamError，其它响应原样返回由调用方处理。
+// 这里还没有向客户端写出任何数据，所以重试是安全的。
+func sendUpstream(r *http.Request, p config.Provider, url string, body []byte, header http.Header, timeout time.Duration) (*http.Response, error) {
+	rc := retrySettings()
+	for attempt := 1; ; attempt++ {
+		resp, err := sendOnce(r, p, url, body, header, timeout)
+		var ue *UpstreamError
+		if err == nil {
+			notifyResponse(r)
+			return resp, nil
+		}
+		if !errors.As(err, &ue) || attempt >= rc.MaxAttempts {
+			return resp, err
+		}
+		delay, ok := retryDelay(ue, attempt, rc)
+		if !ok || !takeRetryBudget(r, delay) {
+			return nil, err
+		}
+		log.Printf("[retry] %v, retrying in %v (attempt %d/%d)", err, delay, attempt+1, rc.MaxAttempts)
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+func sendOnce(r *http.Request, p config.Provider, url string, body []byte, header http.Header, timeout time.Duration) (*http.Response, error) {
 	client := &http.Client{Timeout: timeout}
-	url := strings.TrimRight(p.BaseURL, "/") + "/v1/messages"
-	httpReq, _ := http.NewRequestWithContext(r.Context(), "POST", url, bytes.NewReader(arBody))
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("x-api-key", p.APIKey)
-	httpReq.Header.Set("anthropic-version", "2023-06-01")
+	httpReq, _ := http.NewRequestWithContext(r.Context(), "POST", url, bytes.NewReader(body))
+	for k, vs := range header {
+		httpReq.Header[k] = vs
+	}
 
+	start := time.Now()
+	// 影子请求不计入延迟统计
+	shadow := isShadow(r)
+	observe := func(failed bool) {
+		if !shadow {
+			recordLatency(p.ID, time.Since(start), failed)
+		}
+	}
 	resp, err := client.Do(httpReq)
 	if err != nil {
-		log.Printf("[DEBUG] Anthropic request error: %v", err)
-		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusBadGateway)
+		log.Printf("[DEBUG] upstream request error (provider %s): %v", p.ID, err)
+		if r.Context().Err() != nil {
+			// 客户端已经断开，没必要再换 provider
+			return nil, err
+		}
+		observe(true)
+		return nil, &UpstreamError{Provider: p.ID, Err: err}
+	}
+	if isRetryableStatus(resp.StatusCode) {
+		observe(true)
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		log.Printf("[DEBUG] ===== Upstream Error Response (provider %s, status %d) =====\n%s", p.ID, resp.StatusCode, string(respBody))
+		return nil, &UpstreamError{Provider: p.ID, Status: resp.StatusCode, Header: resp.Header, Body: respBody}
+	}
+	observe(false)
+	return resp, nil
+}
+
+func adapterOptions(model string) adapter.Options {
+	c := config.Get()
+	caps, _ := LookupCapability(model)
+	return adapter.Options{
+		MaxImageBytes:     c.Images.MaxBytes,
+		MaxOutputTokens:   caps.MaxOutputTokens,
+		NoThinking:        !supports(caps.Thinking),
+		NoVision:          !supports(caps.Vision),
+		NoTools:           !supports(caps.Tools),
+		ExclusiveSampling: caps.ExclusiveSampling,
+	}
+}
+
+// validateResponseFormat 开启 response_format.validate 时按请求的 response_format 校验输出
+func validateResponseFormat(req adapter.OAIRequest, content string) error {
+	if !config.Get().ResponseFormat.Validate {
+		return nil
+	}
+	return adapter.ValidateResponseFormat(req.ResponseFormat, content)
+}
+
+// writeResponseFormatError 输出不符合 schema 时直接返回 502。这不是 provider 故障，
+// 不换 provider 重试，也不计入熔断
+func writeResponseFormatError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadGateway)
+	json.NewEncoder(w).Encode(map[string]string{"error": "response does not match response_format: " + err.Error()})
+}
+
+// InlineImages 在故障转移之前把请求里的 http(s) 图片下载为 data URL，所有尝试（包括重试、对冲和 n > 1 的并发请求）共用；
+// 只有开启 images.fetch 且候选中有 Anthropic provider 时才下载
+func InlineImages(r *http.Request, req *adapter.OAIRequest, routes []Route) {
+	c := config.Get()
+	if !c.Images.Fetch || !slices.ContainsFunc(routes, func(rt Route) bool { return rt.Provider.Type == "anthropic" }) {
 		return
 	}
+	adapter.InlineImages(r.Context(), req, c.Images.MaxBytes)
+}
+
+// ProxyMessagesOpenAI 把 Anthropic 原生 /v1/messages 请求转换后发给 OpenAI 兼容的 provider，
+// 响应（包括 SSE 流）再转回 Anthropic 格式
+func ProxyMessagesOpenAI(w http.ResponseWriter, r *http.Request, body []byte, p config.Provider, model, originalModel string, timeout time.Duration) error {
+	caps, known := LookupCapability(model)
+	// OpenAI 上游只有能力表里明确支持 thinking 的模型才发 reasoning_effort
+	req, err := adapter.MessagesToOpenAI(body, model, known && caps.Thinking != nil && *caps.Thinking)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(adapter.OpenAIErrorToAnthropic([]byte(err.Error()), http.StatusBadRequest))
+		return nil
+	}
+	oaiBody, _ := json.Marshal(req)
+	log.Printf("[DEBUG] ===== Messages -> OpenAI Request =====\n%s", indentJSON(oaiBody))
+
+	url := strings.TrimRight(p.BaseURL, "/") + "/v1/chat/completions"
+	resp, err := sendUpstream(r, p, url, oaiBody, openaiHeader(p), timeout)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		respBody, _ := io.ReadAll(resp.Body)
+		log.Printf("[DEBUG] ===== OpenAI Error Response =====\n%s", string(respBody))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(adapter.OpenAIErrorToAnthropic(respBody, resp.StatusCode))
+		return nil
+	}
+
+	if !req.Stream {
+		respBody, _ := io.ReadAll(resp.Body)
+		var oai adapter.OAIResponse
+		if err := json.Unmarshal(respBody, &oai); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write(adapter.OpenAIErrorToAnthropic([]byte("decode error"), http.StatusBadGateway))
+			return nil
+		}
+		usage := adapter.ToAnthropicUsage(oai.Usage)
+		recordUsage(r, p, model, &usage)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(mustMarshal(adapter.OpenAIToMessagesResponse(oai, originalModel)))
+		return nil
+	}
+
+	flusher, ok := startSSE(w)
+	if !ok {
+		return nil
+	}
+	write := func(events []adapter.AnthropicEvent) {
+		for _, e := range events {
+			fmt.Fprint(w, adapter.FormatAnthropicEvent(e))
+		}
+		flusher.Flush()
+	}
+	state := &adapter.MessagesStreamState{}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	var streamErr error
+	for scanner.Scan() {
+		// "data:" 后面的空格可有可无
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		data = strings.TrimPrefix(data, " ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		if streamErr = adapter.StreamChunkError([]byte(data)); streamErr != nil {
+			break
+		}
+		var chunk adapter.OAIResponse
+		if json.Unmarshal([]byte(data), &chunk) != nil {
+			continue
+		}
+		write(adapter.OpenAIChunkToEvents(chunk, state, originalModel))
+	}
+	if streamErr == nil {
+		streamErr = scanner.Err()
+	}
+	if streamErr == nil && state.StopReason == "" && r.Context().Err() == nil {
+		streamErr = adapter.ErrStreamTruncated
+	}
+	write(adapter.FinishMessagesStream(state, originalModel, streamErr))
+	recordUsage(r, p, model, &state.Usage)
+	return streamFailure(r, p, streamErr)
+}
+
+func anthropicHeader(p config.Provider) http.Header {
+	h := http.Header{}
+	h.Set("Content-Type", "application/json")
+	h.Set("x-api-key", p.APIKey)
+	h.Set("anthropic-version", "2023-06-01")
+	return h
+}
+
+func openaiHeader(p config.Provider) http.Header {
+	h := http.Header{}
+	h.Set("Content-Type", "application/json")
+	h.Set("Authorization", "Bearer "+p.APIKey)
+	return h
+}
+
+func ProxyAnthropic(w http.ResponseWriter, r *http.Request, req adapter.OAIRequest, p config.Provider, model string, timeout time.Duration) error {
+	ar := adapter.OpenaiToAnthropic(req, model, adapterOptions(model))
+	arBody, _ := json.Marshal(ar)
+	if p.PromptCache {
+		arBody = adapter.ApplyPromptCache(arBody)
+	}
+
+	log.Printf("[DEBUG] ===== Anthropic Request =====\n%s", indentJSON(arBody))
+
+	url := strings.TrimRight(p.BaseURL, "/") + "/v1/messages"
+	if req.N != nil && *req.N > 1 {
+		return proxyAnthropicN(w, r, req, p, model, url, arBody, *req.N, timeout)
+	}
+	resp, err := sendUpstream(r, p, url, arBody, anthropicHeader(p), timeout)
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
 
 	log.Printf("[DEBUG] Anthropic response status: %d", resp.StatusCode)
@@ -97,40 +559,49 @@ func ProxyAnthropic(w http.ResponseWriter, r *http.Request, req adapter.OAIReque
 		respBody, _ := io.ReadAll(resp.Body)
 		log.Printf("[DEBUG] ===== Anthropic Error Response =====\n%s", string(respBody))
 		w.Write(respBody)
-		return
+		return nil
 	}
 
 	if req.Stream {
-		StreamAnthropicToOpenAI(w, resp.Body, req.Model)
+		usage, err := StreamAnthropicToOpenAI(w, resp.Body, req.Model, &adapter.StreamState{
+			IncludeUsage: req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+			Structured:   adapter.HasStructuredOutput(req.ResponseFormat),
+		})
+		recordUsage(r, p, model, &usage)
+		return streamFailure(r, p, err)
 	} else {
 		respBody, _ := io.ReadAll(resp.Body)
 		log.Printf("[DEBUG] ===== Anthropic Response =====\n%s", indentJSON(respBody))
 		var ar adapter.AnthropicResponse
 		if err := json.Unmarshal(respBody, &ar); err != nil {
 			http.Error(w, `{"error":"decode error"}`, http.StatusBadGateway)
-			return
+			return nil
 		}
+		recordUsage(r, p, model, ar.Usage)
 		oai := adapter.AnthropicToOpenai(ar, req.Model)
+		if fr := oai.Choices[0].FinishReason; *fr == "stop" {
+			if err := validateResponseFormat(req, oai.Choices[0].Message.Content); err != nil {
+				log.Printf("[response_format] provider %s: %v", p.ID, err)
+				writeResponseFormatError(w, err)
+				return nil
+			}
+		}
 		oaiBody, _ := json.Marshal(oai)
 		log.Printf("[DEBUG] ===== OAI Response =====\n%s", indentJSON(oaiBody))
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(oaiBody)
 	}
+	return nil
 }
 
-func ProxyAnthropicRaw(w http.ResponseWriter, r *http.Request, body []byte, p config.Provider, originalModel string, timeout time.Duration) {
-	client := &http.Client{Timeout: timeout}
+func ProxyAnthropicRaw(w http.ResponseWriter, r *http.Request, body []byte, p config.Provider, originalModel string, timeout time.Duration) error {
+	if p.PromptCache {
+		body = adapter.ApplyPromptCache(body)
+	}
 	url := strings.TrimRight(p.BaseURL, "/") + "/v1/messages"
-	httpReq, _ := http.NewRequestWithContext(r.Context(), "POST", url, bytes.NewReader(body))
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("x-api-key", p.APIKey)
-	httpReq.Header.Set("anthropic-version", "2023-06-01")
-
-	resp, err := client.Do(httpReq)
+	resp, err := sendUpstream(r, p, url, body, anthropicHeader(p), timeout)
 	if err != nil {
-		log.Printf("[DEBUG] Anthropic request error: %v", err)
-		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusBadGateway)
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
@@ -142,33 +613,82 @@ func ProxyAnthropicRaw(w http.ResponseWriter, r *http.Request, body []byte, p co
 		respBody, _ := io.ReadAll(resp.Body)
 		log.Printf("[DEBUG] ===== Anthropic Error Response =====\n%s", string(respBody))
 		w.Write(respBody)
-		return
+		return nil
 	}
 
 	// 响应需要转换为 OpenAI 格式，因为请求来自 /v1/chat/completions
 	isStream := strings.Contains(resp.Header.Get("Content-Type"), "event-stream")
 	if isStream {
-		StreamAnthropicToOpenAI(w, resp.Body, originalModel)
+		usage, err := StreamAnthropicToOpenAI(w, resp.Body, originalModel, &adapter.StreamState{})
+		recordUsage(r, p, bodyModel(body), &usage)
+		return streamFailure(r, p, err)
 	} else {
 		respBody, _ := io.ReadAll(resp.Body)
 		log.Printf("[DEBUG] ===== Anthropic Raw Response =====\n%s", string(respBody))
 		var ar adapter.AnthropicResponse
 		if err := json.Unmarshal(respBody, &ar); err != nil {
 			http.Error(w, `{"error":"decode error"}`, http.StatusBadGateway)
-			return
+			return nil
 		}
+		recordUsage(r, p, bodyModel(body), ar.Usage)
 		oai := adapter.AnthropicToOpenai(ar, originalModel)
 		oaiBody, _ := json.Marshal(oai)
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(oaiBody)
 	}
+	return nil
+}
+
+// StreamAnthropicToOpenAI 把 Anthropic SSE 流转换为 OpenAI chunk 写出，返回累计的用量和上游流中途出现的错误
+func StreamAnthropicToOpenAI(w http.ResponseWriter, body io.Reader, model string, state *adapter.StreamState) (adapter.AnthropicUsage, error) {
+	flusher, ok := startSSE(w)
+	if !ok {
+		return adapter.AnthropicUsage{}, nil
+	}
+	err := scanAnthropicSSE(body, func(event string, data json.RawMessage) {
+		for _, chunk := range adapter.AnthropicStreamEventToChunks(event, data, state, model) {
+			writeChunk(w, flusher, chunk)
+		}
+	})
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+	return state.Usage, err
+}
+
+// copyStream 原样转发 SSE 流，读完已到达的数据就 flush；onData 依次收到每个 data 行的内容，
+// 只在回调期间有效
+func copyStream(w http.ResponseWriter, body io.Reader, onData func(data []byte)) error {
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	flusher, _ := w.(http.Flusher)
+	br := bufio.NewReaderSize(body, 32*1024)
+	partial := false // 上一段是超长行被截断的前半部分
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			w.Write(line)
+			if data, ok := bytes.CutPrefix(line, []byte("data:")); ok && !partial {
+				onData(bytes.TrimSpace(data))
+			}
+			if flusher != nil && br.Buffered() == 0 {
+				flusher.Flush()
+			}
+		}
+		partial = errors.Is(err, bufio.ErrBufferFull)
+		if err != nil && !partial {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return err
+		}
+	}
 }
 
-func StreamAnthropicToOpenAI(w http.ResponseWriter, body io.Reader, model string) {
+func startSSE(w http.ResponseWriter) (http.Flusher, bool) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "streaming not supported", http.StatusInternalServerError)
-		return
+		return nil, false
 	}
 
 	rc := http.NewResponseController(w)
@@ -177,12 +697,16 @@ func StreamAnthropicToOpenAI(w http.ResponseWriter, body io.Reader, model string
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
+	return flusher, true
+}
 
-	state := &adapter.StreamState{}
+// scanAnthropicSSE 逐个读出 Anthropic SSE 事件，返回读取错误或流中的 error 事件（例如 overloaded_error）
+func scanAnthropicSSE(body io.Reader, handle func(event string, data json.RawMessage)) error {
 	scanner := bufio.NewScanner(body)
 	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
 
 	var currentEvent string
+	var eventErr error
 	for scanner.Scan() {
 		line := scanner.Text()
 		if strings.HasPrefix(line, "event: ") {
@@ -194,15 +718,21 @@ func StreamAnthropicToOpenAI(w http.ResponseWriter, body io.Reader, model string
 		}
 		data := strings.TrimPrefix(line, "data: ")
 		log.Printf("[DEBUG] [SSE] event=%s data=%s", currentEvent, data)
-		chunks := adapter.AnthropicStreamEventToChunks(currentEvent, json.RawMessage(data), state, model)
-		for _, chunk := range chunks {
-			sse := adapter.FormatSSEChunk(chunk)
-			log.Printf("[DEBUG] [SSE->OAI] %s", strings.TrimSpace(sse))
-			fmt.Fprint(w, sse)
-			flusher.Flush()
+		if currentEvent == "error" && eventErr == nil {
+			eventErr = fmt.Errorf("error event: %s", data)
 		}
+		handle(currentEvent, json.RawMessage(data))
 	}
-	fmt.Fprint(w, "data: [DONE]\n\n")
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return eventErr
+}
+
+func writeChunk(w http.ResponseWriter, flusher http.Flusher, chunk adapter.OAIResponse) {
+	sse := adapter.FormatSSEChunk(chunk)
+	log.Printf("[DEBUG] [SSE->OAI] %s", strings.TrimSpace(sse))
+	fmt.Fprint(w, sse)
 	flusher.Flush()
 }
 
@@ -219,23 +749,19 @@ func indentJSON(data []byte) string {
 	return string(data)
 }
 
-func ProxyOpenAI(w http.ResponseWriter, r *http.Request, body []byte, req adapter.OAIRequest, p config.Provider, model string, timeout time.Duration) {
+func ProxyOpenAI(w http.ResponseWriter, r *http.Request, body []byte, req adapter.OAIRequest, p config.Provider, model string, timeout time.Duration) error {
 	var raw map[string]json.RawMessage
 	json.Unmarshal(body, &raw)
 	modelJSON, _ := json.Marshal(model)
 	raw["model"] = modelJSON
+	// thinking 是本代理的扩展字段，OpenAI 不认识
+	delete(raw, "thinking")
 	newBody, _ := json.Marshal(raw)
 
-	client := &http.Client{Timeout: timeout}
 	url := strings.TrimRight(p.BaseURL, "/") + "/v1/chat/completions"
-	httpReq, _ := http.NewRequestWithContext(r.Context(), "POST", url, bytes.NewReader(newBody))
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+p.APIKey)
-
-	resp, err := client.Do(httpReq)
+	resp, err := sendUpstream(r, p, url, newBody, openaiHeader(p), timeout)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusBadGateway)
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
@@ -246,24 +772,79 @@ func ProxyOpenAI(w http.ResponseWriter, r *http.Request, body []byte, req adapte
 	}
 	w.WriteHeader(resp.StatusCode)
 
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(w, resp.Body)
+		return nil
+	}
+	var usage adapter.AnthropicUsage
 	if req.Stream {
-		rc := http.NewResponseController(w)
-		rc.SetWriteDeadline(time.Time{})
-		flusher, _ := w.(http.Flusher)
-		buf := make([]byte, 32*1024)
-		for {
-			n, err := resp.Body.Read(buf)
-			if n > 0 {
-				w.Write(buf[:n])
-				if flusher != nil {
-					flusher.Flush()
-				}
-			}
-			if err != nil {
-				break
+		err := copyStream(w, resp.Body, func(data []byte) {
+			var chunk adapter.OAIResponse
+			if bytes.Contains(data, []byte(`"usage"`)) && json.Unmarshal(data, &chunk) == nil && chunk.Usage != nil {
+				usage = adapter.ToAnthropicUsage(chunk.Usage)
 			}
+		})
+		recordUsage(r, p, model, &usage)
+		return streamFailure(r, p, err)
+	}
+	respBody, _ := io.ReadAll(resp.Body)
+	w.Write(respBody)
+	var oai adapter.OAIResponse
+	if json.Unmarshal(respBody, &oai) == nil {
+		usage = adapter.ToAnthropicUsage(oai.Usage)
+		recordUsage(r, p, model, &usage)
+	}
+	return nil
+}
+
+// ProxyMessages 把 Anthropic 原生 /v1/messages 请求透传给 provider
+func ProxyMessages(w http.ResponseWriter, r *http.Request, body []byte, p config.Provider, timeout time.Duration) error {
+	if p.PromptCache {
+		body = adapter.ApplyPromptCache(body)
+	}
+	url := strings.TrimRight(p.BaseURL, "/") + "/v1/messages"
+	resp, err := sendUpstream(r, p, url, body, anthropicHeader(p), timeout)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
 		}
-	} else {
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK {
 		io.Copy(w, resp.Body)
+		return nil
+	}
+	model := bodyModel(body)
+	isStream := strings.Contains(resp.Header.Get("Content-Type"), "event-stream")
+	if isStream {
+		var usage adapter.AnthropicUsage
+		err := copyStream(w, resp.Body, func(data []byte) {
+			// 用量在 message_start 的 message 里和 message_delta 里
+			var event struct {
+				Message struct {
+					Usage *adapter.AnthropicUsage `json:"usage"`
+				} `json:"message"`
+				Usage *adapter.AnthropicUsage `json:"usage"`
+			}
+			if bytes.Contains(data, []byte(`"usage"`)) && json.Unmarshal(data, &event) == nil {
+				adapter.MergeUsage(&usage, event.Message.Usage)
+				adapter.MergeUsage(&usage, event.Usage)
+			}
+		})
+		recordUsage(r, p, model, &usage)
+		return streamFailure(r, p, err)
+	}
+	respBody, _ := io.ReadAll(resp.Body)
+	w.Write(respBody)
+	var ar adapter.AnthropicResponse
+	if json.Unmarshal(respBody, &ar) == nil {
+		recordUsage(r, p, model, ar.Usage)
 	}
+	return nil
 }
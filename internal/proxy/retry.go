@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cursor-api-2-claude/internal/config"
+)
+
+func retrySettings() config.RetryConfig {
+	rc := config.Get().Retry
+	if rc.MaxAttempts <= 0 {
+		rc.MaxAttempts = 1
+	}
+	if rc.BaseDelayMs == 0 {
+		rc.BaseDelayMs = 500
+	}
+	if rc.MaxDelayMs == 0 {
+		rc.MaxDelayMs = 10000
+	}
+	if rc.BudgetMs == 0 {
+		rc.BudgetMs = 30000
+	}
+	return rc
+}
+
+// retryDelay 计算下一次重试前的等待时间。上游给出 Retry-After 或
+// anthropic-ratelimit-*-reset 时以它为准，超过单次上限则放弃重试；
+// 否则按指数退避加随机抖动。
+func retryDelay(ue *UpstreamError, attempt int, rc config.RetryConfig) (time.Duration, bool) {
+	maxDelay := time.Duration(rc.MaxDelayMs) * time.Millisecond
+	if d, ok := serverDelay(ue.Header); ok {
+		return d, d <= maxDelay
+	}
+	d := time.Duration(rc.BaseDelayMs) * time.Millisecond << (attempt - 1)
+	if d <= 0 || d > maxDelay {
+		d = maxDelay
+	}
+	// 等待时间在 [d/2, d] 之间随机，避免多个请求同时重试
+	return d/2 + time.Duration(rand.Int64N(int64(d/2)+1)), true
+}
+
+func serverDelay(h http.Header) (time.Duration, bool) {
+	if h == nil {
+		return 0, false
+	}
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil {
+			return time.Duration(secs * float64(time.Second)), true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return max(time.Until(t), 0), true
+		}
+	}
+	// 只看已经耗尽（对应的 -remaining 为 0）的限额，多个耗尽时取最晚的重置时间
+	var latest time.Time
+	for k, vs := range h {
+		k = strings.ToLower(k)
+		if !strings.HasPrefix(k, "anthropic-ratelimit-") || !strings.HasSuffix(k, "-reset") || len(vs) == 0 {
+			continue
+		}
+		if h.Get(strings.TrimSuffix(k, "-reset")+"-remaining") != "0" {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, vs[0]); err == nil && t.After(latest) {
+			latest = t
+		}
+	}
+	if !latest.IsZero() {
+		return max(time.Until(latest), 0), true
+	}
+	return 0, false
+}
+
+type retryBudgetKey struct{}
+
+type retryBudget struct {
+	mu        sync.Mutex
+	remaining time.Duration
+}
+
+// WithRetryBudget 给请求挂上累计重试等待预算，同一客户端请求的所有 provider 共享
+func WithRetryBudget(r *http.Request) *http.Request {
+	b := &retryBudget{remaining: time.Duration(retrySettings().BudgetMs) * time.Millisecond}
+	return r.WithContext(context.WithValue(r.Context(), retryBudgetKey{}, b))
+}
+
+func takeRetryBudget(r *http.Request, d time.Duration) bool {
+	b, ok := r.Context().Value(retryBudgetKey{}).(*retryBudget)
+	if !ok {
+		return d <= time.Duration(retrySettings().BudgetMs)*time.Millisecond
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if d > b.remaining {
+		return false
+	}
+	b.remaining -= d
+	return true
+}
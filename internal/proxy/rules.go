@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"cursor-api-2-claude/internal/config"
+)
+
+// Features 是路由规则可以匹配的请求特征
+type Features struct {
+	Model        string
+	HasTools     bool
+	HasImages    bool
+	Stream       bool
+	PromptTokens int // 按 4 字节 ≈ 1 token 粗略估算，不含图片数据
+	APIKey       string
+	Header       http.Header
+}
+
+// ExtractFeatures 从请求体中提取路由特征，同时兼容 OpenAI 和 Anthropic 格式
+func ExtractFeatures(r *http.Request, body []byte, apiKey string) Features {
+	var probe struct {
+		Model    string            `json:"model"`
+		Stream   bool              `json:"stream"`
+		Tools    []json.RawMessage `json:"tools"`
+		Messages []struct {
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	json.Unmarshal(body, &probe)
+
+	f := Features{
+		Model:    probe.Model,
+		HasTools: len(probe.Tools) > 0,
+		Stream:   probe.Stream,
+		APIKey:   apiKey,
+		Header:   r.Header,
+	}
+	imageBytes := 0
+	for _, m := range probe.Messages {
+		n, found := scanImages(m.Content)
+		imageBytes += n
+		f.HasImages = f.HasImages || found
+	}
+	// base64 图片会让请求体膨胀几十倍，估算 token 时扣掉
+	f.PromptTokens = max(len(body)-imageBytes, 0) / 4
+	return f
+}
+
+// scanImages 检查内容数组（包括 tool_result 的嵌套内容）里是否有图片，并返回图片数据的字节数
+func scanImages(raw json.RawMessage) (n int, found bool) {
+	var parts []struct {
+		Type     string          `json:"type"`
+		Content  json.RawMessage `json:"content"`
+		ImageURL struct {
+			URL string `json:"url"`
+		} `json:"image_url"`
+		Source struct {
+			Data string `json:"data"`
+			URL  string `json:"url"`
+		} `json:"source"`
+	}
+	if json.Unmarshal(raw, &parts) != nil {
+		return 0, false
+	}
+	for _, p := range parts {
+		switch p.Type {
+		case "image_url":
+			n += len(p.ImageURL.URL)
+			found = true
+		case "image":
+			n += len(p.Source.Data) + len(p.Source.URL)
+			found = true
+		}
+		if len(p.Content) > 0 {
+			m, ok := scanImages(p.Content)
+			n += m
+			found = found || ok
+		}
+	}
+	return n, found
+}
+
+// Resolve 先按路由规则匹配，没有命中规则时按模型映射解析
+func Resolve(f Features, c config.Config) []Route {
+	base := ResolveModel(f.Model, c)
+	for _, rule := range c.RoutingRules {
+		if !rule.Enabled || !ruleMatches(rule, f) {
+			continue
+		}
+		routes := ruleRoutes(rule, f.Model, base, c)
+		if len(routes) == 0 {
+			log.Printf("[rules] rule %q matched but has no usable provider, skipping", rule.Name)
+			continue
+		}
+		log.Printf("[rules] rule %q matched model %s", rule.Name, f.Model)
+		return routes
+	}
+	return base
+}
+
+func ruleMatches(rule config.RoutingRule, f Features) bool {
+	if len(rule.Models) > 0 {
+		ok := false
+		for _, pattern := range rule.Models {
+			if _, matched := matchModel(config.ModelRoute{From: pattern}, f.Model); matched {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if rule.HasTools != nil && *rule.HasTools != f.HasTools {
+		return false
+	}
+	if rule.HasImages != nil && *rule.HasImages != f.HasImages {
+		return false
+	}
+	if rule.Stream != nil && *rule.Stream != f.Stream {
+		return false
+	}
+	if rule.MinPromptTokens > 0 && f.PromptTokens < rule.MinPromptTokens {
+		return false
+	}
+	if rule.MaxPromptTokens > 0 && f.PromptTokens > rule.MaxPromptTokens {
+		return false
+	}
+	if len(rule.APIKeys) > 0 {
+		ok := false
+		for _, k := range rule.APIKeys {
+			if k == f.APIKey {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	for name, pattern := range rule.Headers {
+		if _, matched := matchModel(config.ModelRoute{From: pattern}, f.Header.Get(name)); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func ruleRoutes(rule config.RoutingRule, model string, base []Route, c config.Config) []Route {
+	if len(rule.Providers) == 0 {
+		if rule.Model == "" {
+			return base
+		}
+		routes := make([]Route, len(base))
+		for i, rt := range base {
+			rt.Model = rule.Model
+			// 规则改写了模型，不再属于灰度的任何一组
+			rt.Variant = ""
+			routes[i] = rt
+		}
+		return routes
+	}
+
+	byProvider := map[string]Route{}
+	for _, rt := range base {
+		byProvider[rt.Provider.ID] = rt
+	}
+	var routes []Route
+	for _, id := range rule.Providers {
+		if rt, ok := byProvider[id]; ok {
+			if rule.Model != "" {
+				rt.Model = rule.Model
+				rt.Variant = ""
+			}
+			routes = append(routes, rt)
+			continue
+		}
+		// 规则指定了模型时，provider 不需要有匹配的模型映射
+		if rule.Model == "" {
+			continue
+		}
+		for _, p := range c.Providers {
+			if p.ID == id && p.Weight > 0 {
+				routes = append(routes, Route{Provider: p, Model: rule.Model})
+				break
+			}
+		}
+	}
+	return routes
+}
+
+func validateRules(c config.Config) error {
+	for _, rule := range c.RoutingRules {
+		for _, id := range rule.Providers {
+			if !providerExists(c, id) {
+				return fmt.Errorf("routing rule %q: unknown provider %s", rule.Name, id)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExtractFeaturesPromptTokens(t *testing.T) {
+	img := strings.Repeat("A", 40000)
+	tests := []struct {
+		name       string
+		body       string
+		wantImages bool
+		maxTokens  int
+	}{
+		{"text only", `{"model":"m","messages":[{"role":"user","content":"` + strings.Repeat("x", 400) + `"}]}`, false, 150},
+		{"openai image", `{"model":"m","messages":[{"role":"user","content":[{"type":"text","text":"hi"},{"type":"image_url","image_url":{"url":"data:image/png;base64,` + img + `"}}]}]}`, true, 100},
+		{"anthropic image", `{"model":"m","messages":[{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"` + img + `"}}]}]}`, true, 100},
+		{"nested tool_result image", `{"model":"m","messages":[{"role":"user","content":[{"type":"tool_result","tool_use_id":"t","content":[{"type":"image","source":{"type":"base64","data":"` + img + `"}}]}]}]}`, true, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := ExtractFeatures(httptest.NewRequest("POST", "/", nil), []byte(tt.body), "")
+			if f.HasImages != tt.wantImages {
+				t.Fatalf("HasImages = %v, want %v", f.HasImages, tt.wantImages)
+			}
+			if f.PromptTokens > tt.maxTokens {
+				t.Fatalf("PromptTokens = %d, want <= %d", f.PromptTokens, tt.maxTokens)
+			}
+		})
+	}
+}
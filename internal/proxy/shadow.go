@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"cursor-api-2-claude/internal/config"
+)
+
+const (
+	shadowHistorySize = 200
+	shadowMaxOutput   = 4096
+)
+
+type ShadowRecord struct {
+	Time             time.Time `json:"time"`
+	RequestModel     string    `json:"request_model"`
+	PrimaryProvider  string    `json:"primary_provider"`
+	PrimaryModel     string    `json:"primary_model"`
+	Provider         string    `json:"provider"`
+	Model            string    `json:"model"`
+	Status           int       `json:"status"`
+	LatencyMs        int64     `json:"latency_ms"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Output           string    `json:"output"`
+	Error            string    `json:"error,omitempty"`
+}
+
+var (
+	shadowRecords   []ShadowRecord
+	shadowRecordsMu sync.Mutex
+)
+
+// Shadow 按采样率把请求异步镜像到影子 provider。影子响应写入缓冲区，不会返回给客户端，
+// 只记录延迟、状态、用量和输出文本，用于和主路由对比。
+func Shadow(r *http.Request, requestModel string, routes []Route, attempt func(w http.ResponseWriter, r *http.Request, rt Route) error) {
+	var primary Route
+	var sc *config.ShadowConfig
+	for _, rt := range routes {
+		if rt.Shadow != nil && rt.Shadow.SampleRate > 0 {
+			primary, sc = rt, rt.Shadow
+			break
+		}
+	}
+	if sc == nil || rand.Float64() >= sc.SampleRate {
+		return
+	}
+	var shadow Route
+	for _, p := range config.Get().Providers {
+		if p.ID == sc.Provider {
+			shadow = Route{Provider: p, Model: sc.Model}
+			break
+		}
+	}
+	if shadow.Provider.ID == "" {
+		return
+	}
+	if shadow.Model == "" {
+		shadow.Model = primary.Model
+	}
+
+	// 影子请求不跟随客户端连接，客户端断开后仍然跑完
+	timeout := Timeout(shadow.Provider)
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), shadowKey{}, true), timeout)
+	sr := r.Clone(ctx)
+	go func() {
+		defer cancel()
+		out := newBufferWriter()
+		start := time.Now()
+		err := attempt(out, sr, shadow)
+		rec := ShadowRecord{
+			Time:            start,
+			RequestModel:    requestModel,
+			PrimaryProvider: primary.Provider.ID,
+			PrimaryModel:    primary.Model,
+			Provider:        shadow.Provider.ID,
+			Model:           shadow.Model,
+			LatencyMs:       time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			rec.Error = err.Error()
+			var ue *UpstreamError
+			if errors.As(err, &ue) {
+				rec.Status = ue.Status
+			}
+		} else {
+			rec.Status = out.status
+			rec.Output, rec.PromptTokens, rec.CompletionTokens = summarizeResponse(out)
+			if rec.Status >= 400 {
+				rec.Error = truncate(out.buf.String(), shadowMaxOutput)
+			}
+		}
+		log.Printf("[shadow] %s -> %s/%s status=%d latency=%dms", requestModel, rec.Provider, rec.Model, rec.Status, rec.LatencyMs)
+
+		shadowRecordsMu.Lock()
+		shadowRecords = append(shadowRecords, rec)
+		if len(shadowRecords) > shadowHistorySize {
+			shadowRecords = shadowRecords[len(shadowRecords)-shadowHistorySize:]
+		}
+		shadowRecordsMu.Unlock()
+	}()
+}
+
+type shadowKey struct{}
+
+// isShadow 判断是否为影子请求，影子请求不计入延迟、熔断和用量统计
+func isShadow(r *http.Request) bool {
+	v, _ := r.Context().Value(shadowKey{}).(bool)
+	return v
+}
+
+// ShadowRecords 返回最近的影子请求记录，最新的在前
+func ShadowRecords() []ShadowRecord {
+	shadowRecordsMu.Lock()
+	defer shadowRecordsMu.Unlock()
+	list := make([]ShadowRecord, 0, len(shadowRecords))
+	for i := len(shadowRecords) - 1; i >= 0; i-- {
+		list = append(list, shadowRecords[i])
+	}
+	return list
+}
+
+type usageCounts struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	InputTokens      int `json:"input_tokens"`
+	OutputTokens     int `json:"output_tokens"`
+}
+
+// summarizeResponse 从缓存的响应中提取输出文本和 token 用量，
+// 兼容 OpenAI / Anthropic 两种格式的 JSON 和 SSE 响应
+func summarizeResponse(b *bufferWriter) (string, int, int) {
+	var text strings.Builder
+	var in, out int
+	collect := func(data []byte) {
+		var v struct {
+			Choices []struct {
+				Message *struct {
+					Content string `json:"content"`
+				} `json:"message"`
+				Delta *struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Content []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"content"`
+			Delta struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"delta"`
+			Message struct {
+				Usage *usageCounts `json:"usage"`
+			} `json:"message"`
+			Usage *usageCounts `json:"usage"`
+		}
+		if json.Unmarshal(data, &v) != nil {
+			return
+		}
+		for _, c := range v.Choices {
+			if c.Message != nil {
+				text.WriteString(c.Message.Content)
+			}
+			if c.Delta != nil {
+				text.WriteString(c.Delta.Content)
+			}
+		}
+		for _, c := range v.Content {
+			if c.Type == "text" {
+				text.WriteString(c.Text)
+			}
+		}
+		if v.Delta.Type == "text_delta" {
+			text.WriteString(v.Delta.Text)
+		}
+		for _, u := range []*usageCounts{v.Message.Usage, v.Usage} {
+			if u == nil {
+				continue
+			}
+			if n := u.PromptTokens + u.InputTokens; n > 0 {
+				in = n
+			}
+			if n := u.CompletionTokens + u.OutputTokens; n > 0 {
+				out = n
+			}
+		}
+	}
+
+	if strings.Contains(b.header.Get("Content-Type"), "event-stream") || bytes.HasPrefix(bytes.TrimSpace(b.buf.Bytes()), []byte("event:")) || bytes.HasPrefix(bytes.TrimSpace(b.buf.Bytes()), []byte("data:")) {
+		scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+		scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "data: ") && line != "data: [DONE]" {
+				collect([]byte(strings.TrimPrefix(line, "data: ")))
+			}
+		}
+	} else {
+		collect(b.buf.Bytes())
+	}
+	return truncate(text.String(), shadowMaxOutput), in, out
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	// 在 rune 边界截断，避免切开多字节字符
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "..."
+}
@@ -10,6 +10,7 @@ import (
 	"cursor-api-2-claude/internal/config"
 	"cursor-api-2-claude/internal/handler"
 	"cursor-api-2-claude/internal/middleware"
+	"cursor-api-2-claude/internal/proxy"
 
 	"github.com/gin-gonic/gin"
 )
@@ -22,6 +23,8 @@ func main() {
 		log.Fatal("load config:", err)
 	}
 
+	proxy.StartHealthChecker()
+
 	publicSub, _ := fs.Sub(publicFS, "public")
 	handler.PublicFS = publicSub
 	staticFS, _ := fs.Sub(publicFS, "public/static")
@@ -45,6 +48,12 @@ func main() {
 		adminAPI.POST("/providers/test", handler.TestProvider)
 		adminAPI.POST("/providers/models", handler.FetchModels)
 		adminAPI.POST("/providers/test-model", handler.TestModel)
+		adminAPI.GET("/breakers", handler.GetBreakers)
+		adminAPI.GET("/health", handler.GetHealth)
+		adminAPI.GET("/stats", handler.GetStats)
+		adminAPI.GET("/shadow", handler.GetShadow)
+		adminAPI.GET("/canary", handler.GetCanaries)
+		adminAPI.PUT("/canary", handler.PutCanary)
 	}
 
 	// Proxy API (API key auth)
@@ -86,11 +86,12 @@ function switchTab(name){
 
 function closeModal(id){document.getElementById(id).classList.remove('show')}
 
-function addModelRow(from,to,enabled){
+function addModelRow(from,to,enabled,extra){
   if(enabled===undefined)enabled=true;
   const el=document.getElementById('p-models');
   const div=document.createElement('div');
   div.className='model-item'+(enabled?'':' disabled');
+  div.dataset.extra=JSON.stringify(extra||{});
   div.innerHTML=`<label class="toggle"><input type="checkbox" ${enabled?'checked':''} onchange="this.closest('.model-item').classList.toggle('disabled',!this.checked)"><span></span></label><input placeholder="请求模型名 (如 gpt-4o)" value="${esc(from||'')}"><span class="arrow">→</span><input placeholder="实际模型名" value="${esc(to||'')}"><button class="btn-x" onclick="this.parentElement.remove()">×</button>`;
   el.appendChild(div);
 }
@@ -102,7 +103,8 @@ function getModelsFromForm(){
     const inputs=item.querySelectorAll('input[type=text],input[placeholder]');
     const enabled=item.querySelector('.toggle input').checked;
     const from=inputs[0].value.trim(),to=inputs[1].value.trim();
-    if(from&&to)models.push({from,to,enabled});
+    // 保留表单里没有的路由字段（regex 等）
+    if(from&&to)models.push({...JSON.parse(item.dataset.extra||'{}'),from,to,enabled});
   });
   return models;
 }
@@ -122,7 +124,7 @@ function openProviderModal(idx){
     document.getElementById('p-key').value=p.api_key;
     document.getElementById('p-weight').value=p.weight;
     document.getElementById('p-timeout').value=p.timeout;
-    (p.models||[]).forEach(m=>addModelRow(m.from,m.to,m.enabled));
+    (p.models||[]).forEach(m=>addModelRow(m.from,m.to,m.enabled,m));
   }else{
     ['p-id','p-name','p-url','p-key'].forEach(id=>document.getElementById(id).value='');
     document.getElementById('p-type').value='anthropic';
@@ -151,7 +153,7 @@ function saveProvider(){
   const p=getProviderFromForm();
   if(!p.id||!p.base_url){toast('ID 和 URL 必填','err');return}
   const idx=document.getElementById('p-edit-idx').value;
-  if(idx!==''){config.providers[parseInt(idx)]=p}else{config.providers.push(p)}
+  if(idx!==''){config.providers[parseInt(idx)]={...config.providers[parseInt(idx)],...p}}else{config.providers.push(p)}
   closeModal('provider-modal');
   putConfig();
 }